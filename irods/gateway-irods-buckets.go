@@ -0,0 +1,139 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"sync"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// irodsBucketRegistry holds the buckets known to exist. It is updated as soon
+// as this gateway creates or deletes a bucket, and buckets created elsewhere
+// are added when a lookup misses and finds them in the catalog. Entries are
+// trusted for ttl, like the metadata cache, so buckets removed by other
+// gateways or iRODS clients are noticed. Unlike the collection trees cached
+// by GoRODS, it never needs a refresh of the connection pool.
+type irodsBucketRegistry struct {
+	ttl time.Duration
+
+	mu      sync.RWMutex
+	buckets map[string]irodsBucketEntry
+}
+
+// irodsBucketEntry is a registered bucket and when it was seen in the catalog.
+type irodsBucketEntry struct {
+	info    minio.BucketInfo
+	checked time.Time
+}
+
+func newIrodsBucketRegistry(ttl time.Duration) *irodsBucketRegistry {
+	return &irodsBucketRegistry{
+		ttl:     ttl,
+		buckets: make(map[string]irodsBucketEntry),
+	}
+}
+
+// Returns the BucketInfo of bucket, unless it wasn't checked within ttl.
+func (r *irodsBucketRegistry) get(bucket string) (minio.BucketInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.buckets[bucket]
+	if !ok || time.Since(entry.checked) >= r.ttl {
+		return minio.BucketInfo{}, false
+	}
+	return entry.info, true
+}
+
+func (r *irodsBucketRegistry) add(bi minio.BucketInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buckets[bi.Name] = irodsBucketEntry{bi, time.Now()}
+}
+
+func (r *irodsBucketRegistry) remove(bucket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.buckets, bucket)
+}
+
+// Replaces the registered buckets with a full listing.
+func (r *irodsBucketRegistry) reset(buckets []minio.BucketInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.buckets = make(map[string]irodsBucketEntry, len(buckets))
+	for _, bi := range buckets {
+		r.buckets[bi.Name] = irodsBucketEntry{bi, now}
+	}
+}
+
+// getCollection reads the collection at colPath from the catalog.
+func (a *irodsObjects) getCollection(colPath string) (*gorods.Collection, error) {
+	c, err := a.retryIrods(func() (interface{}, error) {
+		col := a.GetCol()
+		defer a.ReturnCol(col)
+
+		return col.Con().Collection(gorods.CollectionOptions{
+			Path: colPath,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*gorods.Collection), nil
+}
+
+// Returns the path of the bucket collection.
+func (a *irodsObjects) getBucketColPath(bucket string) string {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	return col.Path() + "/" + bucket
+}
+
+// lookupBucket returns the BucketInfo of bucket, asking the catalog if it
+// isn't registered or was last checked longer than the cache TTL ago.
+func (a *irodsObjects) lookupBucket(bucket string) (minio.BucketInfo, error) {
+	if bi, ok := a.buckets.get(bucket); ok {
+		return bi, nil
+	}
+
+	bucketCol, err := a.getCollection(a.getBucketColPath(bucket))
+	if isIrodsBackendDown(err) {
+		return minio.BucketInfo{}, err
+	}
+	if err != nil {
+		a.buckets.remove(bucket)
+		return minio.BucketInfo{}, minio.BucketNotFound{Bucket: bucket}
+	}
+
+	bi := minio.BucketInfo{
+		Name:    bucket,
+		Created: bucketCol.CreateTime(),
+	}
+	a.buckets.add(bi)
+	return bi, nil
+}
+
+// getBucketCol returns the collection of bucket, read from the catalog.
+func (a *irodsObjects) getBucketCol(bucket string) (*gorods.Collection, error) {
+	bucketCol, err := a.getCollection(a.getBucketColPath(bucket))
+	if isIrodsBackendDown(err) {
+		return nil, err
+	}
+	if err != nil {
+		a.buckets.remove(bucket)
+		return nil, minio.BucketNotFound{Bucket: bucket}
+	}
+	return bucketCol, nil
+}
@@ -0,0 +1,289 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio/cmd/logger"
+	"github.com/prometheus/client_golang/prometheus"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// Object and bucket lookups are cached for MINIO_IRODS_CACHE_TTL, so the
+// HEAD and GET of one download, or the HEADs of a browser page view, cost a
+// single catalog query. Entries are dropped as soon as this gateway writes or
+// deletes them, changes made through other gateways or iRODS clients show up
+// once the entry expires.
+const (
+	irodsCacheTTL  = 10 * time.Second
+	irodsCacheSize = 10000
+)
+
+// irodsCacheStats counts cache lookups since startup.
+type irodsCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// irodsCacheEntry holds the ObjectInfo of an object, or the BucketInfo of a
+// bucket if object is empty.
+type irodsCacheEntry struct {
+	key     irodsCacheKey
+	objInfo minio.ObjectInfo
+	bktInfo minio.BucketInfo
+	expires time.Time
+}
+
+type irodsCacheKey struct {
+	bucket string
+	object string
+}
+
+// irodsMetaCache is a size bounded LRU cache of object and bucket lookups.
+// A nil cache caches nothing.
+//
+// A lookup running while its entry is invalidated may have read the catalog
+// before the change, so every invalidation starts a new generation and
+// lookups started in an earlier one aren't stored.
+type irodsMetaCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[irodsCacheKey]*list.Element
+	gen     uint64
+
+	stats irodsCacheStats
+}
+
+// newIrodsMetaCache returns a cache of at most size entries, or nil if ttl is 0.
+func newIrodsMetaCache(ttl time.Duration, size int) *irodsMetaCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &irodsMetaCache{
+		ttl:     ttl,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[irodsCacheKey]*list.Element),
+	}
+}
+
+// Returns the unexpired entry for key.
+func (c *irodsMetaCache) get(key irodsCacheKey) (*irodsCacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*irodsCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			atomic.AddUint64(&c.stats.Hits, 1)
+			return entry, true
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+	return nil, false
+}
+
+// Returns the current generation, to be passed to put with the result of a
+// lookup started now.
+func (c *irodsMetaCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Stores entry, evicting the least recently used entries beyond size. Entries
+// looked up before generation gen ended are dropped.
+func (c *irodsMetaCache) put(entry *irodsCacheEntry, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	entry.expires = time.Now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*irodsCacheEntry).key)
+		atomic.AddUint64(&c.stats.Evictions, 1)
+	}
+}
+
+// Drops the entry for key.
+func (c *irodsMetaCache) remove(key irodsCacheKey) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// Drops the entries of bucket and of every object in it.
+func (c *irodsMetaCache) removeBucket(bucket string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for key, elem := range c.entries {
+		if key.bucket == bucket {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Stats returns the hit, miss and eviction counts of the cache.
+func (c *irodsMetaCache) Stats() irodsCacheStats {
+	if c == nil {
+		return irodsCacheStats{}
+	}
+	return irodsCacheStats{
+		Hits:      atomic.LoadUint64(&c.stats.Hits),
+		Misses:    atomic.LoadUint64(&c.stats.Misses),
+		Evictions: atomic.LoadUint64(&c.stats.Evictions),
+	}
+}
+
+var (
+	irodsCacheHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("minio", "irods_cache", "hits_total"),
+		"Object and bucket lookups answered by the iRODS metadata cache", nil, nil)
+	irodsCacheMissesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("minio", "irods_cache", "misses_total"),
+		"Object and bucket lookups the iRODS metadata cache couldn't answer", nil, nil)
+	irodsCacheEvictionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("minio", "irods_cache", "evictions_total"),
+		"Entries evicted from the iRODS metadata cache to stay within its size", nil, nil)
+)
+
+// irodsCacheCollector exports the cache stats as Prometheus counters, served
+// by minio at /minio/prometheus/metrics along with its own.
+type irodsCacheCollector struct {
+	cache *irodsMetaCache
+}
+
+func (c irodsCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- irodsCacheHitsDesc
+	ch <- irodsCacheMissesDesc
+	ch <- irodsCacheEvictionsDesc
+}
+
+func (c irodsCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(irodsCacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(irodsCacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(irodsCacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+}
+
+// Returns the cached ObjectInfo of object. UserDefined is copied, callers
+// may modify it.
+func (a *irodsObjects) getCachedObjectInfo(bucket, object string) (minio.ObjectInfo, bool) {
+	entry, ok := a.cache.get(irodsCacheKey{bucket, object})
+	if !ok {
+		return minio.ObjectInfo{}, false
+	}
+	objInfo := entry.objInfo
+	if entry.objInfo.UserDefined != nil {
+		objInfo.UserDefined = make(map[string]string, len(entry.objInfo.UserDefined))
+		for k, v := range entry.objInfo.UserDefined {
+			objInfo.UserDefined[k] = v
+		}
+	}
+	return objInfo, true
+}
+
+// cacheObjectInfo stores the ObjectInfo of a lookup started in generation gen.
+func (a *irodsObjects) cacheObjectInfo(objInfo minio.ObjectInfo, gen uint64) {
+	a.cache.put(&irodsCacheEntry{
+		key:     irodsCacheKey{objInfo.Bucket, objInfo.Name},
+		objInfo: objInfo,
+	}, gen)
+}
+
+// invalidateObject drops the cached ObjectInfo of object after this gateway
+// changed it.
+func (a *irodsObjects) invalidateObject(bucket, object string) {
+	a.cache.remove(irodsCacheKey{bucket, object})
+}
+
+// Returns the cached BucketInfo of bucket.
+func (a *irodsObjects) getCachedBucketInfo(bucket string) (minio.BucketInfo, bool) {
+	entry, ok := a.cache.get(irodsCacheKey{bucket: bucket})
+	if !ok {
+		return minio.BucketInfo{}, false
+	}
+	return entry.bktInfo, true
+}
+
+// cacheBucketInfo stores the BucketInfo of a lookup started in generation gen.
+func (a *irodsObjects) cacheBucketInfo(bi minio.BucketInfo, gen uint64) {
+	a.cache.put(&irodsCacheEntry{
+		key:     irodsCacheKey{bucket: bi.Name},
+		bktInfo: bi,
+	}, gen)
+}
+
+// invalidateBucket drops the cached BucketInfo of bucket and the ObjectInfo
+// of its objects.
+func (a *irodsObjects) invalidateBucket(bucket string) {
+	a.cache.removeBucket(bucket)
+}
+
+// Logs the cache stats every interval until the gateway shuts down.
+func (a *irodsObjects) runCacheStats() {
+	if a.cache == nil || a.cacheStatsInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.cacheStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			stats := a.cache.Stats()
+			logger.Info("Metadata cache: %d hits, %d misses, %d evictions", stats.Hits, stats.Misses, stats.Evictions)
+		}
+	}
+}
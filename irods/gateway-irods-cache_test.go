@@ -0,0 +1,94 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIrodsMetaCache(t *testing.T) {
+	type cacheStep struct {
+		op     string // put, stale-put, get, remove or remove-bucket
+		bucket string
+		object string
+		hit    bool
+	}
+	testCases := []struct {
+		ttl   time.Duration
+		size  int
+		steps []cacheStep
+	}{
+		// Hits until removed
+		{time.Minute, 10, []cacheStep{
+			{"get", "b", "x", false},
+			{"put", "b", "x", false},
+			{"get", "b", "x", true},
+			{"get", "b", "y", false},
+			{"remove", "b", "x", false},
+			{"get", "b", "x", false},
+		}},
+		// The least recently used entry is evicted
+		{time.Minute, 2, []cacheStep{
+			{"put", "b", "x", false},
+			{"put", "b", "y", false},
+			{"get", "b", "x", true},
+			{"put", "b", "z", false},
+			{"get", "b", "y", false},
+			{"get", "b", "x", true},
+			{"get", "b", "z", true},
+		}},
+		// Removing a bucket drops its objects only
+		{time.Minute, 10, []cacheStep{
+			{"put", "b", "", false},
+			{"put", "b", "x", false},
+			{"put", "c", "x", false},
+			{"remove-bucket", "b", "", false},
+			{"get", "b", "", false},
+			{"get", "b", "x", false},
+			{"get", "c", "x", true},
+		}},
+		// Lookups that raced with an invalidation aren't stored
+		{time.Minute, 10, []cacheStep{
+			{"stale-put", "b", "x", false},
+			{"get", "b", "x", false},
+			{"put", "b", "x", false},
+			{"get", "b", "x", true},
+		}},
+		// Entries expire after ttl
+		{time.Nanosecond, 10, []cacheStep{
+			{"put", "b", "x", false},
+			{"get", "b", "x", false},
+		}},
+		// A ttl of 0 disables the cache
+		{0, 10, []cacheStep{
+			{"put", "b", "x", false},
+			{"get", "b", "x", false},
+		}},
+	}
+
+	for i, testCase := range testCases {
+		c := newIrodsMetaCache(testCase.ttl, testCase.size)
+		for j, step := range testCase.steps {
+			key := irodsCacheKey{step.bucket, step.object}
+			switch step.op {
+			case "put":
+				c.put(&irodsCacheEntry{key: key}, c.generation())
+			case "stale-put":
+				gen := c.generation()
+				c.remove(key)
+				c.put(&irodsCacheEntry{key: key}, gen)
+			case "get":
+				if _, hit := c.get(key); hit != step.hit {
+					t.Errorf("Test %d, step %d: get(%v) hit %v, expected %v", i+1, j+1, key, hit, step.hit)
+				}
+			case "remove":
+				c.remove(key)
+			case "remove-bucket":
+				c.removeBucket(step.bucket)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"io"
+)
+
+// GoRODS calls can't be interrupted, so cancelled requests are stopped
+// between them: copies check the request context before every read and
+// listings before every catalog query or object they look at.
+
+// irodsContextReader fails reads once ctx is done.
+type irodsContextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *irodsContextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// copyIrods copies src to dst until EOF, an error or until ctx is cancelled.
+func copyIrods(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, &irodsContextReader{ctx, src})
+}
+
+// closePipeOnCancel closes pw with the error of ctx once it is done, failing
+// a write blocked on the reader. The returned stop function ends the watch.
+func closePipeOnCancel(ctx context.Context, pw *io.PipeWriter) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pw.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,215 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+)
+
+// irodsCatalog answers the metadata queries ListObjects, GetObjectInfo and
+// ListObjectParts are built on. Rows hold meta_attr_value, modify_ts,
+// data_size, data_checksum and data_name, sorted by value. An empty units
+// matches AVUs with any units.
+type irodsCatalog interface {
+	queryMetaPrefix(attr, units, prefix string) ([][]string, error)
+	queryMetaValue(attr, units, value string) ([][]string, error)
+}
+
+// selectCatalog looks objects up with the specific queries if any version of
+// them is installed, and with GenQuery otherwise or if forceGenQuery is set.
+func (a *irodsObjects) selectCatalog(forceGenQuery bool) {
+	if !forceGenQuery {
+		col := a.GetCol()
+		_, err := col.Con().IQuestSQL(irodsStatQuery, irodsObjMetaAttr, "")
+		installed := err == nil || a.useLegacyQueries(col)
+		a.ReturnCol(col)
+
+		if installed {
+			a.catalog = irodsRetryCatalog{a, irodsSpecificQueries{a}}
+			return
+		}
+		logger.Info("Specific queries %v and %v are not installed, objects are looked up with GenQuery", irodsListQuery, irodsStatQuery)
+	}
+
+	// One general query per lookup if iquest can run it
+	if a.iquest != "" {
+		if iquest, err := exec.LookPath(a.iquest); err == nil {
+			a.iquest = iquest
+		} else {
+			logger.Info("%v not found, GenQuery lookups read the AVUs of every matched object", a.iquest)
+			a.iquest = ""
+		}
+	}
+
+	a.catalog = irodsRetryCatalog{a, irodsGenQuery{a}}
+	a.genQuery = true
+}
+
+// irodsGenQuery looks objects up with general queries on the AVUs of data
+// objects, which need no rodsadmin to install anything. Lookups are scoped
+// to the bucket collection if units names the bucket, and to the mount
+// collection otherwise. GenQuery LIKE has no escape character and quotes
+// can't be escaped, so the catalog is asked for a broader match and rows are
+// filtered by the gateway.
+//
+// GoRODS only exposes GenQuery through QueryMeta, which returns the matching
+// data objects without their AVUs. If the iquest icommand is available the
+// rows are selected with one query instead, see queryIQuest.
+type irodsGenQuery struct {
+	a *irodsObjects
+}
+
+func (q irodsGenQuery) queryMetaPrefix(attr, units, prefix string) ([][]string, error) {
+	cond := prefix
+	if i := strings.Index(cond, "'"); i >= 0 {
+		cond = cond[:i]
+	}
+	return q.query(attr, units, "like", cond+"%", q.a.scanTimeout, func(value string) bool {
+		return strings.HasPrefix(value, prefix)
+	})
+}
+
+func (q irodsGenQuery) queryMetaValue(attr, units, value string) ([][]string, error) {
+	op, cond := "=", value
+	if i := strings.Index(value, "'"); i >= 0 {
+		op, cond = "like", value[:i]+"%"
+	}
+	return q.query(attr, units, op, cond, q.a.opTimeout, func(v string) bool {
+		return v == value
+	})
+}
+
+// Returns the collection the data objects of a query with units live in, or
+// below.
+func (q irodsGenQuery) collection(units string) (colPath string, exact bool) {
+	if units != "" {
+		return q.a.colPath + "/" + units, true
+	}
+	return q.a.colPath + "/", false
+}
+
+// Runs the metadata query attr op cond and returns a row for every attr AVU
+// with units on the matched data objects whose value satisfies match. An
+// iquest run is stopped after timeout unless it is 0.
+func (q irodsGenQuery) query(attr, units, op, cond string, timeout time.Duration, match func(string) bool) ([][]string, error) {
+	if q.a.iquest != "" {
+		return q.queryIQuest(attr, units, op, cond, timeout, match)
+	}
+
+	col := q.a.GetCol()
+	defer q.a.ReturnCol(col)
+
+	objs, err := col.Con().QueryMeta(fmt.Sprintf("%v %v '%v'", attr, op, cond))
+	if err != nil {
+		return nil, err
+	}
+
+	colPath, exact := q.collection(units)
+	var rows [][]string
+	for _, obj := range objs {
+		dataObj, ok := obj.(*gorods.DataObj)
+		if !ok {
+			continue
+		}
+		if objCol := path.Dir(dataObj.Path()); (exact && objCol != colPath) || !strings.HasPrefix(objCol+"/", colPath) {
+			continue
+		}
+
+		// An exact match doesn't need the AVUs read back, unless their units
+		// have to be checked
+		if op == "=" && units == "" {
+			rows = append(rows, genQueryObjectRow(dataObj, cond))
+			continue
+		}
+		metas, mErr := dataObj.Attribute(attr)
+		if mErr != nil {
+			return nil, mErr
+		}
+		for _, m := range metas {
+			if (units != "" && m.Units != units) || !match(m.Value) {
+				continue
+			}
+			rows = append(rows, genQueryObjectRow(dataObj, m.Value))
+		}
+	}
+	return sortIrodsObjectRows(rows), nil
+}
+
+// Returns the row for the AVU value of dataObj.
+func genQueryObjectRow(dataObj *gorods.DataObj, value string) []string {
+	return []string{
+		value,
+		strconv.FormatInt(dataObj.ModTime().Unix(), 10),
+		strconv.FormatInt(dataObj.Size(), 10),
+		dataObj.Checksum(),
+		dataObj.Name(),
+	}
+}
+
+// The icommand general queries are run with by default.
+const irodsIQuest = "iquest"
+
+// Separate the columns and rows iquest prints, the AVU value comes last as
+// it is the only column which may hold them.
+const (
+	irodsIQuestColumnSep = "\x1f"
+	irodsIQuestRowSep    = "\x1e"
+)
+
+// queryIQuest selects the AVU value and units and the modify time, size,
+// checksum and name of the matching data objects with a single general
+// query run by iquest.
+func (q irodsGenQuery) queryIQuest(attr, units, op, cond string, timeout time.Duration, match func(string) bool) ([][]string, error) {
+	colPath, exact := q.collection(units)
+	where := []string{
+		fmt.Sprintf("META_DATA_ATTR_NAME = '%v'", attr),
+		fmt.Sprintf("META_DATA_ATTR_VALUE %v '%v'", op, cond),
+	}
+	if exact {
+		where = append(where,
+			fmt.Sprintf("META_DATA_ATTR_UNITS = '%v'", units),
+			fmt.Sprintf("COLL_NAME = '%v'", colPath))
+	} else {
+		where = append(where, fmt.Sprintf("COLL_NAME like '%v%%'", colPath))
+	}
+	query := "select META_DATA_ATTR_UNITS, DATA_MODIFY_TIME, DATA_SIZE, DATA_CHECKSUM, DATA_NAME, META_DATA_ATTR_VALUE where " +
+		strings.Join(where, " and ")
+	format := strings.Repeat("%s"+irodsIQuestColumnSep, 5) + "%s" + irodsIQuestRowSep
+
+	// Unlike a GoRODS call iquest can be stopped once it takes too long
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	out, err := q.a.irodsICommand(ctx, q.a.iquest, "--no-page", format, query).CombinedOutput()
+	if bytes.Contains(out, []byte("CAT_NO_ROWS_FOUND")) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+
+	var rows [][]string
+	for _, record := range strings.Split(string(out), irodsIQuestRowSep) {
+		cols := strings.SplitN(strings.TrimPrefix(record, "\n"), irodsIQuestColumnSep, 6)
+		if len(cols) != 6 || (units != "" && cols[0] != units) || !match(cols[5]) {
+			continue
+		}
+		rows = append(rows, []string{cols[5], cols[1], cols[2], cols[3], cols[4]})
+	}
+	return sortIrodsObjectRows(rows), nil
+}
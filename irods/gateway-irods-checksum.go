@@ -0,0 +1,352 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	gorods "github.com/jjacquay712/GoRODS"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+const (
+	irodsChecksumMD5      = "md5"
+	irodsChecksumSHA256   = "sha256"
+	irodsSHA2Prefix       = "sha2:"
+	amzChecksumSHA256     = "X-Amz-Checksum-Sha256"
+	amzContentSHA256Empty = "UNSIGNED-PAYLOAD"
+
+	amzChecksumPrefix           = "X-Amz-Checksum-"
+	amzChecksumAlgorithm        = "X-Amz-Checksum-Algorithm"
+	amzSdkChecksumAlgorithm     = "X-Amz-Sdk-Checksum-Algorithm"
+	amzChecksumMode             = "X-Amz-Checksum-Mode"
+	amzTrailer                  = "X-Amz-Trailer"
+	irodsChecksumMetaAttrPrefix = "minio_checksum_"
+)
+
+// irodsChecksum is a checksum as computed by iRODS and stored in
+// R_DATA_MAIN.data_checksum. Zones using the MD5 hash scheme store the hex
+// digest, zones using SHA-256 store "sha2:" followed by the base64 digest.
+type irodsChecksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// parseIrodsChecksum decodes a data_checksum value.
+func parseIrodsChecksum(chkSum string) (irodsChecksum, error) {
+	if strings.HasPrefix(chkSum, irodsSHA2Prefix) {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(chkSum, irodsSHA2Prefix))
+		if err != nil || len(sum) != sha256.Size {
+			return irodsChecksum{}, fmt.Errorf("Invalid iRODS SHA-256 checksum %v", chkSum)
+		}
+		return irodsChecksum{Algorithm: irodsChecksumSHA256, Sum: sum}, nil
+	}
+
+	sum, err := hex.DecodeString(chkSum)
+	if err != nil || len(sum) != md5.Size {
+		return irodsChecksum{}, fmt.Errorf("Invalid iRODS MD5 checksum %v", chkSum)
+	}
+	return irodsChecksum{Algorithm: irodsChecksumMD5, Sum: sum}, nil
+}
+
+// Hex returns the digest in hex, as used by Content-MD5 derived ETags and
+// x-amz-content-sha256.
+func (c irodsChecksum) Hex() string {
+	return hex.EncodeToString(c.Sum)
+}
+
+// Base64 returns the digest in base64, as used by the x-amz-checksum-* headers.
+func (c irodsChecksum) Base64() string {
+	return base64.StdEncoding.EncodeToString(c.Sum)
+}
+
+// String returns the checksum the way iRODS stores it in data_checksum.
+func (c irodsChecksum) String() string {
+	if c.Algorithm == irodsChecksumSHA256 {
+		return irodsSHA2Prefix + c.Base64()
+	}
+	return c.Hex()
+}
+
+// ETag returns the S3 ETag of an object with this checksum. An MD5 is the ETag
+// S3 clients expect, a SHA-256 can't be one and is hashed into an opaque ETag.
+func (c irodsChecksum) ETag() string {
+	if c.Algorithm == irodsChecksumMD5 {
+		return c.Hex()
+	}
+	return getMD5Hash(c.String()) + "-1"
+}
+
+// AddUserDefined exposes a SHA-256 checksum as x-amz-checksum-sha256, unless
+// the object already carries a flexible checksum of that name.
+func (c irodsChecksum) AddUserDefined(userDefined map[string]string) map[string]string {
+	if c.Algorithm != irodsChecksumSHA256 {
+		return userDefined
+	}
+	if userDefined == nil {
+		userDefined = make(map[string]string)
+	}
+	if _, ok := getUserDefined(userDefined, amzChecksumSHA256); !ok {
+		userDefined[amzChecksumSHA256] = c.Base64()
+	}
+	return userDefined
+}
+
+// getRodsObjChecksum parses the data_checksum of the data object at path.
+// Objects registered without a checksum are checksummed on demand, which reads
+// the whole object, so listings don't call it.
+func (a *irodsObjects) getRodsObjChecksum(path, chkSum string) (irodsChecksum, error) {
+	if chkSum == "" {
+		obj, err := a.retryIrods(func() (interface{}, error) {
+			col := a.GetCol()
+			defer a.ReturnCol(col)
+			return col.Con().DataObject(path)
+		})
+		if err != nil {
+			return irodsChecksum{}, err
+		}
+		if chkSum, err = obj.(*gorods.DataObj).Chksum(); err != nil {
+			return irodsChecksum{}, err
+		}
+	}
+	return parseIrodsChecksum(chkSum)
+}
+
+// verifyRodsObjChecksum has iRODS checksum a fully written data object and
+// compares the result with the data the gateway received, hashed into
+// received with SHA-256, and with the digests the client sent. Content-MD5
+// and x-amz-content-sha256 are checked against the received data on every
+// zone, x-amz-checksum-sha256 against the iRODS checksum on SHA-256 zones.
+// Returns the iRODS checksum.
+func verifyRodsObjChecksum(obj *gorods.DataObj, data *minio.PutObjReader, received hash.Hash, userDefined map[string]string) (sum irodsChecksum, err error) {
+	chkSum, err := obj.Chksum()
+	if err != nil {
+		return sum, err
+	}
+
+	if sum, err = parseIrodsChecksum(chkSum); err != nil {
+		return sum, err
+	}
+
+	gotMD5 := data.MD5CurrentHexString()
+	if want := data.MD5HexString(); want != "" && want != gotMD5 {
+		return sum, minio.BadDigest{ExpectedMD5: want, CalculatedMD5: gotMD5}
+	}
+	gotSHA256 := received.Sum(nil)
+	if want := data.SHA256HexString(); want != "" && want != amzContentSHA256Empty && want != hex.EncodeToString(gotSHA256) {
+		return sum, minio.SHA256Mismatch{}
+	}
+
+	switch sum.Algorithm {
+	case irodsChecksumMD5:
+		if gotMD5 != sum.Hex() {
+			return sum, minio.BadDigest{ExpectedMD5: gotMD5, CalculatedMD5: sum.Hex()}
+		}
+	case irodsChecksumSHA256:
+		if !bytes.Equal(gotSHA256, sum.Sum) {
+			return sum, minio.BadDigest{ExpectedMD5: base64.StdEncoding.EncodeToString(gotSHA256), CalculatedMD5: sum.Base64()}
+		}
+		if want, ok := getUserDefined(userDefined, amzChecksumSHA256); ok && want != sum.Base64() {
+			return sum, minio.BadDigest{ExpectedMD5: want, CalculatedMD5: sum.Base64()}
+		}
+	}
+
+	return sum, nil
+}
+
+// S3 flexible checksum algorithms, as named in x-amz-checksum-algorithm.
+var irodsFlexChecksumAlgorithms = map[string]func() hash.Hash{
+	"CRC32":  func() hash.Hash { return crc32.NewIEEE() },
+	"CRC32C": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+}
+
+// irodsFlexChecksum computes one of the S3 flexible checksums while data is
+// streamed into iRODS. The result is stored on the data object as a
+// minio_checksum_<algorithm> AVU.
+type irodsFlexChecksum struct {
+	Algorithm string
+	Expected  string
+	hash      hash.Hash
+}
+
+// getIrodsFlexChecksum returns the checksum requested by x-amz-checksum-algorithm
+// or by a x-amz-checksum-<algorithm> header, or nil if none was requested.
+// Checksums sent in an aws-chunked trailer only reach the gateway after the
+// data has been written, so uploads announcing one with x-amz-trailer are
+// refused rather than stored unverified.
+func getIrodsFlexChecksum(bucket, object string, userDefined map[string]string) (*irodsFlexChecksum, error) {
+	if _, ok := getUserDefined(userDefined, amzTrailer); ok {
+		return nil, minio.NotImplemented{}
+	}
+
+	algorithm, _ := getUserDefined(userDefined, amzChecksumAlgorithm)
+	if algorithm == "" {
+		algorithm, _ = getUserDefined(userDefined, amzSdkChecksumAlgorithm)
+	}
+	algorithm = strings.ToUpper(algorithm)
+
+	if algorithm == "" {
+		for name := range irodsFlexChecksumAlgorithms {
+			if _, ok := getUserDefined(userDefined, irodsFlexChecksumHeader(name)); ok {
+				algorithm = name
+				break
+			}
+		}
+	}
+	if algorithm == "" {
+		return nil, nil
+	}
+
+	newHash, ok := irodsFlexChecksumAlgorithms[algorithm]
+	if !ok {
+		return nil, minio.InvalidArgument{
+			Bucket: bucket,
+			Object: object,
+			Err:    fmt.Errorf("Unsupported checksum algorithm %v", algorithm),
+		}
+	}
+
+	expected, _ := getUserDefined(userDefined, irodsFlexChecksumHeader(algorithm))
+	return &irodsFlexChecksum{
+		Algorithm: algorithm,
+		Expected:  expected,
+		hash:      newHash(),
+	}, nil
+}
+
+// Returns the response header for a checksum algorithm, e.g. X-Amz-Checksum-Crc32c.
+func irodsFlexChecksumHeader(algorithm string) string {
+	return http.CanonicalHeaderKey(amzChecksumPrefix + strings.ToLower(algorithm))
+}
+
+// Returns true for request headers describing flexible checksums, which are
+// not stored as minio_meta_ metadata.
+func isIrodsChecksumHeader(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), strings.ToLower(amzChecksumPrefix)) ||
+		strings.EqualFold(key, amzSdkChecksumAlgorithm) ||
+		strings.EqualFold(key, amzTrailer)
+}
+
+// isIrodsChecksumModeEnabled returns true if the client asked for the
+// checksums of an object with x-amz-checksum-mode: ENABLED.
+func isIrodsChecksumModeEnabled(userDefined map[string]string) bool {
+	mode, _ := getUserDefined(userDefined, amzChecksumMode)
+	return strings.EqualFold(mode, "ENABLED")
+}
+
+// filterIrodsChecksums drops the x-amz-checksum-* headers from objInfo unless
+// the client asked for them. objInfo may be cached, so its metadata is copied.
+func filterIrodsChecksums(objInfo minio.ObjectInfo, enabled bool) minio.ObjectInfo {
+	if enabled {
+		return objInfo
+	}
+	userDefined := make(map[string]string, len(objInfo.UserDefined))
+	for k, v := range objInfo.UserDefined {
+		if !isIrodsChecksumHeader(k) {
+			userDefined[k] = v
+		}
+	}
+	objInfo.UserDefined = userDefined
+	return objInfo
+}
+
+// Reader returns a reader which feeds everything read from r to the checksum.
+func (c *irodsFlexChecksum) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, c.hash)
+}
+
+// Sum returns the base64 checksum of the data read so far.
+func (c *irodsFlexChecksum) Sum() string {
+	return base64.StdEncoding.EncodeToString(c.hash.Sum(nil))
+}
+
+// MetaAttr returns the AVU attribute the checksum is stored under.
+func (c *irodsFlexChecksum) MetaAttr() string {
+	return irodsChecksumMetaAttrPrefix + strings.ToLower(c.Algorithm)
+}
+
+// Verify compares the computed checksum with the one sent by the client, if any.
+func (c *irodsFlexChecksum) Verify() error {
+	if c.Expected != "" && c.Expected != c.Sum() {
+		return minio.BadDigest{ExpectedMD5: c.Expected, CalculatedMD5: c.Sum()}
+	}
+	return nil
+}
+
+// Store adds value as the checksum AVU of obj.
+func (c *irodsFlexChecksum) Store(obj *gorods.DataObj, value string) error {
+	_, err := obj.AddMeta(gorods.Meta{
+		c.MetaAttr(), value, "", nil,
+	})
+	return err
+}
+
+// copyIrodsFlexChecksums adds the minio_checksum_* AVUs of src to dst.
+func copyIrodsFlexChecksums(src, dst *gorods.DataObj) error {
+	mc, err := src.Meta()
+	if err != nil {
+		return err
+	}
+	metas, err := mc.All()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metas {
+		if !strings.HasPrefix(m.Attribute, irodsChecksumMetaAttrPrefix) {
+			continue
+		}
+		if _, err = dst.AddMeta(gorods.Meta{
+			m.Attribute, m.Value, "", nil,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Composite computes the checksum of a multipart object from the checksums of
+// its parts the way S3 does: the checksum of the concatenated binary part
+// checksums, suffixed with the number of parts.
+func (c *irodsFlexChecksum) Composite(partSums []string) (string, error) {
+	h := irodsFlexChecksumAlgorithms[c.Algorithm]()
+	for _, partSum := range partSums {
+		sum, err := base64.StdEncoding.DecodeString(partSum)
+		if err != nil {
+			return "", err
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(partSums)), nil
+}
+
+// getCompositeChecksum reads the checksum every part was uploaded with and
+// combines them. Parts uploaded without the upload's checksum algorithm are
+// rejected, as S3 does.
+func getCompositeChecksum(flexSum *irodsFlexChecksum, parts []minio.CompletePart, partObjs []*gorods.DataObj) (string, error) {
+	partSums := make([]string, 0, len(partObjs))
+	for i, partObj := range partObjs {
+		metas, err := partObj.Attribute(flexSum.MetaAttr())
+		if err != nil || len(metas) == 0 {
+			return "", minio.InvalidPart{PartNumber: parts[i].PartNumber}
+		}
+		partSums = append(partSums, metas[0].Value)
+	}
+	return flexSum.Composite(partSums)
+}
@@ -0,0 +1,118 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"reflect"
+	"testing"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+func TestParseIrodsChecksum(t *testing.T) {
+	testCases := []struct {
+		chkSum    string
+		algorithm string
+		hex       string
+		ok        bool
+	}{
+		{"0cc175b9c0f1b6a831c399e269772661", irodsChecksumMD5, "0cc175b9c0f1b6a831c399e269772661", true},
+		{"sha2:ypeBEsobvcr6wjGzmiPcTaeG7/gUfE5yuYB3ha/uSLs=", irodsChecksumSHA256, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", true},
+		{"", "", "", false},
+		// Wrong length for the algorithm
+		{"0cc175b9c0f1b6a8", "", "", false},
+		{"sha2:" + "0cc175b9c0f1b6a831c399e269772661", "", "", false},
+		// Not hex or not base64
+		{"0cc175b9c0f1b6a831c399e26977266z", "", "", false},
+		{"sha2:ypeBEsobvcr6wjGzmiPcTaeG7/gUfE5yuYB3ha/uSLs", "", "", false},
+		// A SHA-256 without its prefix isn't a valid MD5
+		{"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", "", "", false},
+	}
+
+	for i, testCase := range testCases {
+		sum, err := parseIrodsChecksum(testCase.chkSum)
+		if (err == nil) != testCase.ok {
+			t.Errorf("Test %d: parseIrodsChecksum(%q) returned error %v, expected ok %v", i+1, testCase.chkSum, err, testCase.ok)
+			continue
+		}
+		if !testCase.ok {
+			continue
+		}
+		if sum.Algorithm != testCase.algorithm || sum.Hex() != testCase.hex {
+			t.Errorf("Test %d: parseIrodsChecksum(%q) = %v %v, expected %v %v", i+1,
+				testCase.chkSum, sum.Algorithm, sum.Hex(), testCase.algorithm, testCase.hex)
+		}
+		if sum.String() != testCase.chkSum {
+			t.Errorf("Test %d: %q parsed back to %q", i+1, testCase.chkSum, sum.String())
+		}
+	}
+}
+
+func TestIrodsFlexChecksumComposite(t *testing.T) {
+	testCases := []struct {
+		algorithm string
+		partSums  []string
+		composite string
+		ok        bool
+	}{
+		{"SHA256", []string{"ypeBEsobvcr6wjGzmiPcTaeG7/gUfE5yuYB3ha/uSLs=", "PiPoFgA5WUoziU9lZOGxNIu9egCI1CxKy3PurtWcAJ0="}, "5aAf7hTg7VxIcU8iGA8lrYNltT+XefedxKPX6Tlj+Uo=-2", true},
+		{"CRC32", []string{"6Le+Qw==", "cb7v+Q=="}, "7pJxdw==-2", true},
+		// A single part is still a checksum of checksums
+		{"CRC32", []string{"6Le+Qw=="}, "Zw3NQg==-1", true},
+		{"CRC32", []string{"6Le+Qw==", "not base64"}, "", false},
+	}
+
+	for i, testCase := range testCases {
+		flexSum, err := getIrodsFlexChecksum("bucket", "object", map[string]string{
+			amzChecksumAlgorithm: testCase.algorithm,
+		})
+		if err != nil {
+			t.Fatalf("Test %d: getIrodsFlexChecksum(%v) returned error %v", i+1, testCase.algorithm, err)
+		}
+		composite, err := flexSum.Composite(testCase.partSums)
+		if (err == nil) != testCase.ok {
+			t.Errorf("Test %d: Composite(%q) returned error %v, expected ok %v", i+1, testCase.partSums, err, testCase.ok)
+			continue
+		}
+		if composite != testCase.composite {
+			t.Errorf("Test %d: Composite(%q) = %q, expected %q", i+1, testCase.partSums, composite, testCase.composite)
+		}
+	}
+}
+
+func TestGetIrodsFlexChecksum(t *testing.T) {
+	testCases := []struct {
+		userDefined map[string]string
+		algorithm   string
+		expected    string
+		err         error
+	}{
+		{map[string]string{}, "", "", nil},
+		{map[string]string{amzChecksumAlgorithm: "crc32c"}, "CRC32C", "", nil},
+		{map[string]string{amzSdkChecksumAlgorithm: "SHA1"}, "SHA1", "", nil},
+		{map[string]string{"X-Amz-Checksum-Sha256": "ypeBEsobvcr6wjGzmiPcTaeG7/gUfE5yuYB3ha/uSLs="}, "SHA256", "ypeBEsobvcr6wjGzmiPcTaeG7/gUfE5yuYB3ha/uSLs=", nil},
+		{map[string]string{amzChecksumAlgorithm: "MD5"}, "", "", minio.InvalidArgument{}},
+		{map[string]string{amzTrailer: "x-amz-checksum-crc32"}, "", "", minio.NotImplemented{}},
+	}
+
+	for i, testCase := range testCases {
+		flexSum, err := getIrodsFlexChecksum("bucket", "object", testCase.userDefined)
+		if reflect.TypeOf(err) != reflect.TypeOf(testCase.err) {
+			t.Errorf("Test %d: getIrodsFlexChecksum(%v) returned error %v, expected %T", i+1, testCase.userDefined, err, testCase.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var algorithm, expected string
+		if flexSum != nil {
+			algorithm, expected = flexSum.Algorithm, flexSum.Expected
+		}
+		if algorithm != testCase.algorithm || expected != testCase.expected {
+			t.Errorf("Test %d: getIrodsFlexChecksum(%v) = %q %q, expected %q %q", i+1,
+				testCase.userDefined, algorithm, expected, testCase.algorithm, testCase.expected)
+		}
+	}
+}
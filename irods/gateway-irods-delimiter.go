@@ -0,0 +1,239 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// Delimited listings are grouped by the catalog, so listing the top level of
+// a large bucket costs about as much as the number of entries returned. Both
+// queries use PostgreSQL string functions and work on the minio_key index.
+// Keys and prefixes are compared byte by byte like the gateway does, whatever
+// the collation of the catalog database.
+//
+// irodsListPrefixesQuery returns the distinct common prefixes after a marker:
+// SELECT DISTINCT SUBSTR(R_META_MAIN.meta_attr_value, 1, CHAR_LENGTH(?) + STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) + CHAR_LENGTH(?) - 1) COLLATE "C" AS prefix
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// AND R_META_MAIN.meta_attr_value COLLATE "C" > ? AND STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) > 0
+// ORDER BY prefix ASC LIMIT ?
+//
+// irodsListChildrenQuery returns the objects directly below a prefix after a marker:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// AND R_META_MAIN.meta_attr_value COLLATE "C" > ? AND STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) = 0
+// ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?
+const (
+	irodsListPrefixesQuery = "minio_list_prefixes_v2"
+	irodsListChildrenQuery = "minio_list_children_v2"
+)
+
+// detectDelimiterQueries enables catalog side grouping if its specific
+// queries are installed.
+func (a *irodsObjects) detectDelimiterQueries() {
+	if !a.keyIndex || a.genQuery {
+		return
+	}
+
+	if _, err := a.queryPrefixes("", "", "/", "", 1); err != nil {
+		logger.Info("Specific query %v is not installed, common prefixes are computed by the gateway", irodsListPrefixesQuery)
+		return
+	}
+	if _, err := a.queryChildren("", "", "/", "", 1); err != nil {
+		logger.Info("Specific query %v is not installed, common prefixes are computed by the gateway", irodsListChildrenQuery)
+		return
+	}
+	a.delimiterQueries = true
+}
+
+// canListDelimited returns true if the catalog can group the keys below
+// prefix. Objects only indexed by minio_obj AVUs are grouped by the gateway
+// a page at a time, prefixes longer than the part of a key held by its index
+// AVU need the full listing.
+func (a *irodsObjects) canListDelimited(bucket, prefix string) bool {
+	return a.delimiterQueries && (!a.legacyIndex || a.pagedQueries) && len(prefix) < a.indexedKeyLength(bucket)
+}
+
+// Returns up to limit common prefixes of keys after marker.
+func (a *irodsObjects) queryPrefixes(bucket, prefix, delimiter, marker string, limit int) ([]string, error) {
+	val, err := a.retryIrods(func() (interface{}, error) {
+		col := a.GetCol()
+		defer a.ReturnCol(col)
+
+		return col.Con().IQuestSQL(irodsListPrefixesQuery,
+			prefix, prefix, delimiter, delimiter,
+			irodsKeyMetaAttr, bucket, escapeIrodsLike(prefix)+"%",
+			marker, prefix, delimiter, strconv.Itoa(limit))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := val.([][]string)
+	prefixes := make([]string, 0, len(rows))
+	for _, row := range rows {
+		prefixes = append(prefixes, row[0])
+	}
+	return prefixes, nil
+}
+
+// Returns up to limit rows for the objects directly below prefix after marker.
+func (a *irodsObjects) queryChildren(bucket, prefix, delimiter, marker string, limit int) ([][]string, error) {
+	rows, err := a.retryIrods(func() (interface{}, error) {
+		col := a.GetCol()
+		defer a.ReturnCol(col)
+
+		return col.Con().IQuestSQL(irodsListChildrenQuery,
+			irodsKeyMetaAttr, bucket, escapeIrodsLike(prefix)+"%",
+			marker, prefix, delimiter, strconv.Itoa(limit))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows.([][]string), nil
+}
+
+// listObjectsDelimited implements ListObjects with a delimiter on top of
+// irodsListPrefixesQuery and irodsListChildrenQuery.
+func (a *irodsObjects) listObjectsDelimited(ctx context.Context, bucket, bucketPath, prefix, marker, delimiter string, maxKeys int) (result minio.ListObjectsInfo, err error) {
+	if maxKeys <= 0 {
+		return result, nil
+	}
+	if isIrodsMarker(marker) {
+		marker = ""
+	}
+
+	// One prefix may be the marker itself
+	prefixes, err := a.queryPrefixes(bucket, prefix, delimiter, marker, maxKeys+2)
+	if err != nil {
+		return result, irodsToObjectError(irodsBackendError(err, fmt.Errorf("Error occured listing prefixes in %v", bucket)), bucket, prefix)
+	}
+	if err = ctx.Err(); err != nil {
+		return result, err
+	}
+	rows, err := a.queryChildren(bucket, prefix, delimiter, marker, maxKeys+1)
+	if err != nil {
+		return result, irodsToObjectError(irodsBackendError(err, fmt.Errorf("Error occured listing objects in %v", bucket)), bucket, prefix)
+	}
+	if a.legacyIndex {
+		legacyPrefixes, legacyRows, lErr := a.queryLegacyChildren(ctx, bucket, prefix, delimiter, marker, maxKeys+1)
+		if lErr != nil {
+			return result, irodsToObjectError(irodsBackendError(lErr, fmt.Errorf("Error occured listing objects in %v", bucket)), bucket, prefix)
+		}
+		prefixes = append(prefixes, legacyPrefixes...)
+		sort.Strings(prefixes)
+		rows = append(rows, legacyRows...)
+	}
+	rows = dedupeIrodsObjectRows(sortIrodsObjectRows(a.expandObjectKeys(bucket, prefix, rows)))
+
+	return a.mergeListing(ctx, bucket, bucketPath, prefix, marker, delimiter, maxKeys, prefixes, rows)
+}
+
+// queryLegacyChildren groups the keys below prefix after marker that are
+// indexed by minio_obj AVUs, which the catalog can't group, into common
+// prefixes and rows. It pages through the index until it has at least limit
+// entries or reached its end, skipping past the rest of a common prefix
+// instead of reading it.
+func (a *irodsObjects) queryLegacyChildren(ctx context.Context, bucket, prefix, delimiter, marker string, limit int) (prefixes []string, rows [][]string, err error) {
+	after := marker
+	for {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		val, qErr := a.retryIrods(func() (interface{}, error) {
+			page, next, more, pErr := a.queryIndexSourcesPage(bucket, prefix, after, limit, false, true)
+			return irodsIndexPage{page, next, more}, pErr
+		})
+		if qErr != nil {
+			return nil, nil, qErr
+		}
+		page := val.(irodsIndexPage)
+
+		for _, row := range page.rows {
+			if commonPrefix, ok := getCommonPrefix(row[0], prefix, delimiter); ok {
+				if n := len(prefixes); n == 0 || prefixes[n-1] != commonPrefix {
+					prefixes = append(prefixes, commonPrefix)
+				}
+				continue
+			}
+			rows = append(rows, row)
+		}
+		if !page.more || len(prefixes)+len(rows) >= limit {
+			return prefixes, rows, nil
+		}
+
+		after = page.next
+		if commonPrefix, ok := getCommonPrefix(page.next, prefix, delimiter); ok {
+			after = commonPrefix + string(utf8.MaxRune)
+		}
+	}
+}
+
+// mergeListing builds one page of a delimited listing from the common
+// prefixes and the rows of the objects directly below prefix, both sorted.
+func (a *irodsObjects) mergeListing(ctx context.Context, bucket, bucketPath, prefix, marker, delimiter string, maxKeys int, prefixes []string, rows [][]string) (result minio.ListObjectsInfo, err error) {
+	type listEntry struct {
+		name string
+		row  []string
+	}
+	entries := make([]listEntry, 0, len(prefixes)+len(rows))
+	seen := make(map[string]bool)
+	addPrefix := func(p string) {
+		if p <= marker || isIrodsSysTmp(p, prefix) || seen[p] {
+			return
+		}
+		seen[p] = true
+		entries = append(entries, listEntry{name: p})
+	}
+
+	for _, p := range prefixes {
+		addPrefix(p)
+	}
+	for _, row := range rows {
+		if isIrodsSysTmp(row[0], prefix) {
+			continue
+		}
+		// Keys continued past their index AVU may hold the delimiter
+		if commonPrefix, ok := getCommonPrefix(row[0], prefix, delimiter); ok {
+			addPrefix(commonPrefix)
+			continue
+		}
+		entries = append(entries, listEntry{name: row[0], row: row})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		result.IsTruncated = true
+		result.NextMarker = entries[maxKeys-1].name
+	}
+
+	for _, entry := range entries {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		if entry.row == nil {
+			result.Prefixes = append(result.Prefixes, entry.name)
+			continue
+		}
+		result.Objects = append(result.Objects, a.rowObjectInfo(ctx, bucket, bucketPath, entry.row))
+	}
+
+	return result, nil
+}
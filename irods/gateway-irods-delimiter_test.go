@@ -0,0 +1,155 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGetCommonPrefix(t *testing.T) {
+	testCases := []struct {
+		key, prefix, delimiter string
+		commonPrefix           string
+		ok                     bool
+	}{
+		{"a/b/c", "", "/", "a/", true},
+		{"a/b/c", "a/", "/", "a/b/", true},
+		{"a/b", "a/", "/", "", false},
+		{"a/b", "b/", "/", "", false},
+		{"a/b", "", "", "", false},
+		// Multi-character delimiters
+		{"2018--01--02", "", "--", "2018--", true},
+		{"2018--01--02", "2018--", "--", "2018--01--", true},
+		{"2018-01-02", "", "--", "", false},
+		{"a---b", "", "--", "a--", true},
+		// UTF-8 keys and delimiters
+		{"día/mes/año", "", "/", "día/", true},
+		{"día/mes/año", "día/", "/", "día/mes/", true},
+		{"日本語の鍵", "", "の", "日本語の", true},
+		{"日本語の鍵", "日本語の", "の", "", false},
+		{"ä€b", "", "€", "ä€", true},
+		// Delimiter equal to the prefix, only matches after the prefix
+		{"/", "/", "/", "", false},
+		{"/a", "/", "/", "", false},
+		{"/a/b", "/", "/", "/a/", true},
+		{"//", "/", "/", "//", true},
+		{"xyx", "x", "x", "xyx", true},
+	}
+
+	for i, testCase := range testCases {
+		commonPrefix, ok := getCommonPrefix(testCase.key, testCase.prefix, testCase.delimiter)
+		if commonPrefix != testCase.commonPrefix || ok != testCase.ok {
+			t.Errorf("Test %d: getCommonPrefix(%q, %q, %q) = %q, %v, expected %q, %v", i+1,
+				testCase.key, testCase.prefix, testCase.delimiter, commonPrefix, ok, testCase.commonPrefix, testCase.ok)
+		}
+	}
+}
+
+func TestIsIrodsSysTmp(t *testing.T) {
+	testCases := []struct {
+		name, prefix string
+		sysTmp       bool
+	}{
+		{"minio.sys.tmp/", "", true},
+		{"minio.sys.tmp/abc", "", true},
+		{"minio.sys.tmp/abc", "minio", true},
+		{"minio.sys.tmp/abc", "minio.sys.tmp/", false},
+		{"minio.sys.tmp/abc", "minio.sys.tmp/a", false},
+		{"minio.sys.tmp", "", false},
+		{"minio.sys.tmpfile", "", false},
+		{"a/minio.sys.tmp/", "", false},
+		{"abc", "", false},
+	}
+
+	for i, testCase := range testCases {
+		if sysTmp := isIrodsSysTmp(testCase.name, testCase.prefix); sysTmp != testCase.sysTmp {
+			t.Errorf("Test %d: isIrodsSysTmp(%q, %q) = %v, expected %v", i+1,
+				testCase.name, testCase.prefix, sysTmp, testCase.sysTmp)
+		}
+	}
+}
+
+// Returns a row as returned by queryObjects for key.
+func getTestIrodsRow(key string) []string {
+	return []string{key, "1546300800", "0", "", getMD5Hash(key)}
+}
+
+func TestMergeListing(t *testing.T) {
+	testCases := []struct {
+		prefix, marker, delimiter string
+		maxKeys                   int
+		prefixes                  []string
+		keys                      []string
+
+		objects     []string
+		commonPrefs []string
+		nextMarker  string
+	}{
+		// Objects and common prefixes are interleaved in key order
+		{"", "", "/", 10, []string{"a/", "c/"}, []string{"b", "d"},
+			[]string{"b", "d"}, []string{"a/", "c/"}, ""},
+		// Truncated on the last entry returned, prefix or object
+		{"", "", "/", 2, []string{"a/", "c/"}, []string{"b", "d"},
+			[]string{"b"}, []string{"a/"}, "b"},
+		{"", "", "/", 3, []string{"a/", "c/"}, []string{"b", "d"},
+			[]string{"b"}, []string{"a/", "c/"}, "c/"},
+		// Keys continued past their index AVU may hold the delimiter
+		{"", "", "/", 10, []string{"a/"}, []string{"a/b", "c/d", "e"},
+			[]string{"e"}, []string{"a/", "c/"}, ""},
+		// Multi-character delimiters
+		{"", "", "--", 10, []string{"2018--"}, []string{"2018--01", "2019", "2019--01--02"},
+			[]string{"2019"}, []string{"2018--", "2019--"}, ""},
+		// UTF-8
+		{"día/", "", "/", 10, []string{"día/mes/"}, []string{"día/año", "día/mes/x", "día/ñ/x"},
+			[]string{"día/año"}, []string{"día/mes/", "día/ñ/"}, ""},
+		// Delimiter equal to the prefix
+		{"/", "", "/", 10, []string{"/a/"}, []string{"/", "/b", "/a/c"},
+			[]string{"/", "/b"}, []string{"/a/"}, ""},
+		// A marker inside a common prefix, the prefix was returned on the
+		// previous page
+		{"", "a/", "/", 10, []string{"a/", "b/"}, []string{"a/c", "c"},
+			[]string{"c"}, []string{"b/"}, ""},
+		{"", "a/b", "/", 10, []string{"a/", "b/"}, []string{"a/c", "c"},
+			[]string{"c"}, []string{"b/"}, ""},
+		// minio.sys.tmp is only listed if asked for
+		{"", "", "/", 10, []string{"a/", "minio.sys.tmp/"}, []string{"minio.sys.tmp/x", "z"},
+			[]string{"z"}, []string{"a/"}, ""},
+		{"minio.sys.tmp/", "", "/", 10, []string{"minio.sys.tmp/multipart/"}, []string{"minio.sys.tmp/x"},
+			[]string{"minio.sys.tmp/x"}, []string{"minio.sys.tmp/multipart/"}, ""},
+	}
+
+	a := &irodsObjects{}
+	for i, testCase := range testCases {
+		rows := make([][]string, 0, len(testCase.keys))
+		for _, key := range testCase.keys {
+			rows = append(rows, getTestIrodsRow(key))
+		}
+
+		result, err := a.mergeListing(context.Background(), "bucket", "/zone/bucket", testCase.prefix,
+			testCase.marker, testCase.delimiter, testCase.maxKeys, testCase.prefixes, rows)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i+1, err)
+		}
+
+		var objects []string
+		for _, objInfo := range result.Objects {
+			objects = append(objects, objInfo.Name)
+		}
+		if !reflect.DeepEqual(objects, testCase.objects) {
+			t.Errorf("Test %d: Expected objects %q, got %q", i+1, testCase.objects, objects)
+		}
+		if !reflect.DeepEqual(result.Prefixes, testCase.commonPrefs) {
+			t.Errorf("Test %d: Expected prefixes %q, got %q", i+1, testCase.commonPrefs, result.Prefixes)
+		}
+		if result.NextMarker != testCase.nextMarker {
+			t.Errorf("Test %d: Expected next marker %q, got %q", i+1, testCase.nextMarker, result.NextMarker)
+		}
+		if result.IsTruncated != (testCase.nextMarker != "") {
+			t.Errorf("Test %d: Expected truncated %v, got %v", i+1, testCase.nextMarker != "", result.IsTruncated)
+		}
+	}
+}
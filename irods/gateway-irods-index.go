@@ -0,0 +1,268 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/cli"
+	"github.com/minio/minio/cmd/logger"
+	"github.com/minio/minio/pkg/auth"
+)
+
+// Objects are indexed with a minio_key AVU on their data object. The value is
+// the object key and the units hold the bucket name, so neither needs to be
+// split out of a concatenated string.
+//
+// Older gateways indexed objects with a minio_obj AVU whose value is the
+// bucket and key joined by ":::::", or "#####" before that. Those are still
+// read until MINIO_IRODS_LEGACY_INDEX is turned off, and can be rewritten
+// with the migrate-index subcommand.
+//
+// irodsListKeysQuery:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// ORDER BY R_META_MAIN.meta_attr_value ASC
+//
+// irodsStatKeyQuery:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value = ?
+// ORDER BY R_META_MAIN.meta_attr_value ASC
+const (
+	irodsKeyMetaAttr   = "minio_key"
+	irodsListKeysQuery = "minio_list_keys_v1"
+	irodsStatKeyQuery  = "minio_stat_key_v1"
+)
+
+// Separators between bucket and key in minio_obj AVU values, newest first.
+var irodsLegacyKeySeparators = []string{":::::", "#####"}
+
+// detectKeyIndex enables the minio_key index if its specific queries are
+// installed, or objects are looked up with GenQuery. Otherwise new objects
+// keep getting minio_obj AVUs.
+func (a *irodsObjects) detectKeyIndex() {
+	if a.genQuery {
+		a.keyIndex = true
+		return
+	}
+
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	if _, err := col.Con().IQuestSQL(irodsStatKeyQuery, irodsKeyMetaAttr, "", ""); err != nil {
+		logger.Info("Specific query %v is not installed, objects are indexed with %v AVUs", irodsStatKeyQuery, irodsObjMetaAttr)
+		return
+	}
+	a.keyIndex = true
+}
+
+// queryObjects returns a row for every object in bucket whose key starts with
+// prefix, sorted by key. Each row holds the object key, modify_ts, data_size,
+// data_checksum and data_name.
+func (a *irodsObjects) queryObjects(bucket, prefix string) ([][]string, error) {
+	rows, err := a.queryIndex(bucket, a.indexedKeyPrefix(bucket, prefix))
+	if err != nil {
+		return nil, err
+	}
+	return sortIrodsObjectRows(a.expandObjectKeys(bucket, prefix, rows)), nil
+}
+
+// Returns the rows of every index AVU in bucket starting with prefix.
+func (a *irodsObjects) queryIndex(bucket, prefix string) ([][]string, error) {
+	return a.queryIndexSources(bucket, prefix, a.keyIndex, a.legacyIndex)
+}
+
+// queryIndexSources is queryIndex restricted to the minio_key index if
+// keyIndex is set and the minio_obj index if legacyIndex is set.
+func (a *irodsObjects) queryIndexSources(bucket, prefix string, keyIndex, legacyIndex bool) ([][]string, error) {
+	var rows [][]string
+
+	if keyIndex {
+		keyRows, err := a.catalog.queryMetaPrefix(irodsKeyMetaAttr, bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, keyRows...)
+	}
+
+	if legacyIndex {
+		for _, sep := range irodsLegacyKeySeparators {
+			legacyRows, err := a.queryMetaPrefix(irodsObjMetaAttr, bucket+sep+prefix)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, trimIrodsLegacyKeys(legacyRows, bucket+sep)...)
+		}
+	}
+
+	return rows, nil
+}
+
+// lookupObject returns the rows indexing object in bucket.
+func (a *irodsObjects) lookupObject(bucket, object string) ([][]string, error) {
+	// Keys split across several AVUs can only be matched by their first part
+	if len(object) >= a.indexedKeyLength(bucket) {
+		rows, err := a.queryObjects(bucket, object)
+		if err != nil {
+			return nil, err
+		}
+		matched := rows[:0]
+		for _, row := range rows {
+			if row[0] == object {
+				matched = append(matched, row)
+			}
+		}
+		return matched, nil
+	}
+
+	var rows [][]string
+
+	if a.keyIndex {
+		keyRows, err := a.catalog.queryMetaValue(irodsKeyMetaAttr, bucket, object)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, keyRows...)
+	}
+
+	if a.legacyIndex {
+		for _, sep := range irodsLegacyKeySeparators {
+			legacyRows, err := a.queryMetaValue(irodsObjMetaAttr, bucket+sep+object)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, trimIrodsLegacyKeys(legacyRows, bucket+sep)...)
+		}
+	}
+
+	return sortIrodsObjectRows(rows), nil
+}
+
+// Strips the bucket and separator from minio_obj values.
+func trimIrodsLegacyKeys(rows [][]string, metaPrefix string) [][]string {
+	for _, row := range rows {
+		row[0] = strings.TrimPrefix(row[0], metaPrefix)
+	}
+	return rows
+}
+
+// Orders rows from several queries by key, as dedupeIrodsObjectRows expects.
+func sortIrodsObjectRows(rows [][]string) [][]string {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rows[i][0] < rows[j][0]
+	})
+	return rows
+}
+
+// addObjectIndex makes obj visible as object in bucket. Keys too long for a
+// single AVU continue in minio_key_cont AVUs.
+func (a *irodsObjects) addObjectIndex(obj *gorods.DataObj, bucket, object string) error {
+	attr, value, units := irodsKeyMetaAttr, object, bucket
+	if !a.keyIndex {
+		attr, value, units = irodsObjMetaAttr, bucket+irodsLegacyKeySeparators[0]+object, ""
+	}
+
+	parts := splitIrodsKey(value, a.maxAVUValue)
+	if _, err := obj.AddMeta(gorods.Meta{
+		attr, parts[0], units, nil,
+	}); err != nil {
+		return err
+	}
+	return addIrodsKeyChain(obj, parts[1:])
+}
+
+// irodsMigrateIndexStats counts what migrateIndex did in one bucket.
+type irodsMigrateIndexStats struct {
+	Migrated int
+	Skipped  int
+}
+
+// migrateIndex replaces the minio_obj AVUs of every object in bucket with
+// minio_key AVUs. Objects that aren't stored under a hash of their key are
+// left alone, they are stale copies of an interrupted overwrite.
+func (a *irodsObjects) migrateIndex(bucket string) (stats irodsMigrateIndexStats, err error) {
+	for _, sep := range irodsLegacyKeySeparators {
+		rows, qErr := a.queryMetaPrefix(irodsObjMetaAttr, bucket+sep)
+		if qErr != nil {
+			return stats, qErr
+		}
+
+		for _, row := range a.expandObjectKeys(bucket, "", trimIrodsLegacyKeys(rows, bucket+sep)) {
+			object := row[0]
+			if !isIrodsObjectName(row[4], object) {
+				stats.Skipped++
+				continue
+			}
+
+			rodsObj, oErr := a.getDataObjInBucket(bucket, row[4])
+			if oErr != nil {
+				return stats, oErr
+			}
+
+			// Migrating twice must not index the object twice. Continued
+			// keys are chained again, the parts have a different length.
+			if metas, _ := rodsObj.Attribute(irodsKeyMetaAttr); len(metas) == 0 {
+				if conts, _ := rodsObj.Attribute(irodsKeyContMetaAttr); len(conts) > 0 {
+					if _, mErr := rodsObj.DeleteMeta(irodsKeyContMetaAttr); mErr != nil {
+						return stats, mErr
+					}
+				}
+				if mErr := a.addObjectIndex(rodsObj, bucket, object); mErr != nil {
+					return stats, mErr
+				}
+			}
+			if _, mErr := rodsObj.DeleteMeta(irodsObjMetaAttr); mErr != nil {
+				return stats, mErr
+			}
+			stats.Migrated++
+		}
+	}
+
+	return stats, nil
+}
+
+// Handler for 'minio gateway irods migrate-index' command line.
+func irodsMigrateIndexMain(ctx *cli.Context) {
+	a := newIrodsCommandLayer(ctx)
+	defer a.Shutdown(context.Background())
+	if !a.keyIndex {
+		logger.FatalIf(fmt.Errorf("specific query %v is not installed", irodsStatKeyQuery), "Unable to migrate the object index")
+	}
+
+	buckets, err := a.ListBuckets(context.Background())
+	logger.FatalIf(err, "Unable to list buckets")
+
+	for _, bucket := range buckets {
+		stats, mErr := a.migrateIndex(bucket.Name)
+		logger.FatalIf(mErr, "Unable to migrate the object index of %v", bucket.Name)
+		fmt.Printf("%v: %d objects migrated, %d stale copies skipped\n", bucket.Name, stats.Migrated, stats.Skipped)
+	}
+}
+
+// Connects to the zone given by the [HOST] [PORT] [ZONE] [COL] arguments of
+// a subcommand, with MINIO_ACCESS_KEY and MINIO_SECRET_KEY as credentials.
+// The gateway's configuration applies, its background workers don't run.
+func newIrodsCommandLayer(ctx *cli.Context) *irodsObjects {
+	// Subcommands scan whole buckets, they wait for iRODS however long it takes
+	g := newIrodsFromEnv(ctx)
+	g.opTimeout, g.scanTimeout = 0, 0
+
+	a, err := g.newIrodsObjects(auth.Credentials{
+		AccessKey: os.Getenv("MINIO_ACCESS_KEY"),
+		SecretKey: os.Getenv("MINIO_SECRET_KEY"),
+	})
+	logger.FatalIf(err, "Unable to connect to iRODS")
+
+	return a
+}
@@ -0,0 +1,253 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+)
+
+const (
+	irodsIncompleteMetaAttr = "minio_incomplete"
+	irodsIncompleteSep      = "|"
+	irodsJanitorInterval    = 6 * time.Hour
+	irodsJanitorMaxAge      = 7 * 24 * time.Hour
+)
+
+// irodsJanitorStats counts what a janitor pass removed from one bucket.
+type irodsJanitorStats struct {
+	Markers    int
+	Parts      int
+	Incomplete int
+	Bytes      int64
+}
+
+// runJanitor removes abandoned multipart uploads, orphaned parts and
+// partially written objects every janitorInterval until the gateway shuts down.
+func (a *irodsObjects) runJanitor() {
+	if a.janitorInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.janitorOnce(context.Background())
+		}
+	}
+}
+
+func (a *irodsObjects) janitorOnce(ctx context.Context) {
+	buckets, err := a.ListBuckets(ctx)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return
+	}
+
+	for _, bucket := range buckets {
+		stats, jErr := a.cleanBucket(ctx, bucket.Name, time.Now())
+		if jErr != nil {
+			logger.LogIf(ctx, fmt.Errorf("iRODS janitor failed on bucket %v: %v", bucket.Name, jErr))
+		}
+		if stats.Markers+stats.Parts+stats.Incomplete > 0 {
+			logger.Info("iRODS janitor reclaimed %d bytes from %v: %d upload markers, %d parts, %d incomplete objects",
+				stats.Bytes, bucket.Name, stats.Markers, stats.Parts, stats.Incomplete)
+		}
+	}
+}
+
+func (a *irodsObjects) cleanBucket(ctx context.Context, bucket string, now time.Time) (stats irodsJanitorStats, err error) {
+	bucketPath := a.colPath + "/" + bucket
+
+	// Remove upload markers past the maximum age, remember the ones left
+	liveUploads := make(map[string]bool)
+	markers, err := a.queryUploadMarkers(bucket)
+	if err != nil {
+		return stats, err
+	}
+	for _, m := range markers {
+		if now.Sub(m.ModTime) < a.janitorMaxAge {
+			liveUploads[m.UploadID] = true
+			continue
+		}
+		col := a.GetCol()
+		marker, oErr := col.Con().DataObject(bucketPath + "/" + m.Name)
+		a.ReturnCol(col)
+		if oErr != nil {
+			continue
+		}
+		if dErr := marker.Destroy(); dErr != nil {
+			logger.LogIf(ctx, dErr)
+			liveUploads[m.UploadID] = true
+			continue
+		}
+		stats.Markers++
+		stats.Bytes += m.Size
+	}
+
+	// Remove upload collections past the maximum age. Parts are written
+	// after their upload started, so they are at least as old as it. Markers
+	// of uploads started by older gateways aren't tagged, their uploads are
+	// only known to be abandoned by age as well.
+	mpCol, err := a.getMultipartCol(bucket)
+	if err != nil {
+		return stats, err
+	}
+	uploadCols, err := mpCol.Collections()
+	if err != nil {
+		return stats, err
+	}
+	for _, uploadCol := range uploadCols {
+		if liveUploads[uploadCol.Name()] || now.Sub(uploadCol.CreateTime()) < a.janitorMaxAge {
+			continue
+		}
+		parts, pErr := uploadCol.DataObjs()
+		if pErr != nil {
+			logger.LogIf(ctx, pErr)
+			continue
+		}
+		var size int64
+		for _, part := range parts {
+			size += part.Size()
+		}
+		if dErr := uploadCol.Destroy(); dErr != nil {
+			logger.LogIf(ctx, dErr)
+			continue
+		}
+		stats.Parts += len(parts)
+		stats.Bytes += size
+	}
+
+	// Parts written by older gateways with the shared multiparts/ layout,
+	// the multipart collection holds nothing else
+	parts, err := mpCol.DataObjs()
+	if err != nil {
+		return stats, err
+	}
+	for _, part := range parts {
+		if now.Sub(part.ModTime()) < a.janitorMaxAge {
+			continue
+		}
+		metas, _ := part.Attribute(irodsMultipartMetaAttr)
+		live := false
+		for _, m := range metas {
+			if liveUploads[m.Value] {
+				live = true
+			}
+		}
+		if live {
+			continue
+		}
+		size := part.Size()
+		if dErr := part.Destroy(); dErr != nil {
+			logger.LogIf(ctx, dErr)
+			continue
+		}
+		stats.Parts++
+		stats.Bytes += size
+	}
+
+	// Remove objects whose write never finished, they carry a
+	// minio_incomplete AVU holding the bucket collection and when they were
+	// marked. Objects marked by older gateways hold only the bucket
+	// collection or their own path, they are aged by their modify_ts.
+	marked, qErr := a.catalog.queryMetaPrefix(irodsIncompleteMetaAttr, bucket, bucketPath+irodsIncompleteSep)
+	if qErr != nil {
+		return stats, qErr
+	}
+	unstamped, qErr := a.catalog.queryMetaValue(irodsIncompleteMetaAttr, bucket, bucketPath)
+	if qErr != nil {
+		return stats, qErr
+	}
+	legacy, qErr := a.queryMetaPrefix(irodsIncompleteMetaAttr, bucketPath+"/")
+	if qErr != nil {
+		return stats, qErr
+	}
+
+	var abandoned []irodsIncompleteObj
+	for _, row := range marked {
+		since, pErr := parseIrodsTimestamp(strings.TrimPrefix(row[0], bucketPath+irodsIncompleteSep))
+		if pErr != nil {
+			continue
+		}
+		abandoned = append(abandoned, newIrodsIncompleteObj(bucketPath+"/"+row[4], since, row))
+	}
+	for _, row := range unstamped {
+		modTime, _ := parseIrodsTimestamp(row[1])
+		abandoned = append(abandoned, newIrodsIncompleteObj(bucketPath+"/"+row[4], modTime, row))
+	}
+	for _, row := range legacy {
+		modTime, _ := parseIrodsTimestamp(row[1])
+		abandoned = append(abandoned, newIrodsIncompleteObj(row[0], modTime, row))
+	}
+
+	for _, obj := range abandoned {
+		if now.Sub(obj.Since) < a.janitorMaxAge {
+			continue
+		}
+
+		col := a.GetCol()
+		rodsObj, oErr := col.Con().DataObject(obj.Path)
+		a.ReturnCol(col)
+		if oErr != nil {
+			continue
+		}
+		if dErr := rodsObj.Destroy(); dErr != nil {
+			logger.LogIf(ctx, dErr)
+			continue
+		}
+		stats.Incomplete++
+		stats.Bytes += obj.Size
+	}
+
+	return stats, nil
+}
+
+// irodsIncompleteObj is a data object tagged by markRodsObjIncomplete.
+type irodsIncompleteObj struct {
+	Path  string
+	Since time.Time
+	Size  int64
+}
+
+// Returns the incomplete object at objPath from its catalog row.
+func newIrodsIncompleteObj(objPath string, since time.Time, row []string) irodsIncompleteObj {
+	size, _ := strconv.ParseInt(row[2], 10, 64)
+	return irodsIncompleteObj{objPath, since, size}
+}
+
+// Tags a data object as being written, so the janitor can find it if the
+// gateway dies before the write completes. The tag holds the bucket
+// collection and the bucket, which stay the same while the object is renamed
+// into place, and the time it was set. Renames don't update the modify_ts of
+// a data object, so an object renamed aside by a commit is aged from then.
+func markRodsObjIncomplete(obj *gorods.DataObj) error {
+	bucketPath := path.Dir(obj.Path())
+	_, err := obj.AddMeta(gorods.Meta{
+		irodsIncompleteMetaAttr,
+		bucketPath + irodsIncompleteSep + strconv.FormatInt(time.Now().Unix(), 10),
+		path.Base(bucketPath),
+		nil,
+	})
+	return err
+}
+
+// Removes the tag set by markRodsObjIncomplete once the object is fully written.
+func markRodsObjComplete(obj *gorods.DataObj) error {
+	_, err := obj.DeleteMeta(irodsIncompleteMetaAttr)
+	return err
+}
@@ -0,0 +1,125 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	gorods "github.com/jjacquay712/GoRODS"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// Object keys are stored in meta_attr_value, which holds irodsMaxAVUValue bytes
+// on most catalogs. Keys that don't fit are split at character boundaries: the
+// index AVU holds the first part, which the catalog sorts and filters on, and
+// minio_key_cont AVUs hold the rest, numbered in their units.
+const (
+	irodsS3MaxKeyLength  = 1024
+	irodsMaxAVUValue     = 2700
+	irodsKeyContMetaAttr = "minio_key_cont"
+)
+
+// checkObjectKey returns minio.ObjectNameTooLong for keys longer than S3 allows.
+func checkObjectKey(bucket, object string) error {
+	if len(object) > irodsS3MaxKeyLength {
+		return minio.ObjectNameTooLong{Bucket: bucket, Object: object}
+	}
+	return nil
+}
+
+// splitIrodsKey splits value into parts of at most limit bytes without
+// splitting UTF-8 characters.
+func splitIrodsKey(value string, limit int) []string {
+	var parts []string
+	for len(value) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(value[n]) {
+			n--
+		}
+		parts = append(parts, value[:n])
+		value = value[n:]
+	}
+	return append(parts, value)
+}
+
+// Returns the bytes of a key which are guaranteed to be in the index AVU of
+// bucket, whichever index format the object uses.
+func (a *irodsObjects) indexedKeyLength(bucket string) int {
+	n := a.maxAVUValue
+	if a.legacyIndex || !a.keyIndex {
+		n -= len(bucket) + len(irodsLegacyKeySeparators[0])
+	}
+	return n - utf8.UTFMax
+}
+
+// Truncates prefix to what the index AVU of any key starting with it holds.
+func (a *irodsObjects) indexedKeyPrefix(bucket, prefix string) string {
+	n := a.indexedKeyLength(bucket)
+	if len(prefix) <= n {
+		return prefix
+	}
+	for n > 0 && !utf8.RuneStart(prefix[n]) {
+		n--
+	}
+	return prefix[:n]
+}
+
+// Adds the minio_key_cont AVUs for the overflow parts of an index value.
+func addIrodsKeyChain(obj *gorods.DataObj, parts []string) error {
+	for i, part := range parts {
+		if _, err := obj.AddMeta(gorods.Meta{
+			irodsKeyContMetaAttr, part, strconv.Itoa(i + 1), nil,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Joins the minio_key_cont AVUs in metas back together.
+func readIrodsKeyChain(metas gorods.Metas) string {
+	var parts []*gorods.Meta
+	for _, m := range metas {
+		if m.Attribute == irodsKeyContMetaAttr {
+			parts = append(parts, m)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		ni, _ := strconv.Atoi(parts[i].Units)
+		nj, _ := strconv.Atoi(parts[j].Units)
+		return ni < nj
+	})
+
+	var b strings.Builder
+	for _, m := range parts {
+		b.WriteString(m.Value)
+	}
+	return b.String()
+}
+
+// expandObjectKeys completes the keys of rows whose index AVU may have been
+// too short to hold them, then drops rows not starting with prefix.
+func (a *irodsObjects) expandObjectKeys(bucket, prefix string, rows [][]string) [][]string {
+	expanded := rows[:0]
+	for _, row := range rows {
+		if len(row[0]) >= a.indexedKeyLength(bucket) {
+			if rodsObj, err := a.getDataObjInBucket(bucket, row[4]); err == nil {
+				if mc, mErr := rodsObj.Meta(); mErr == nil {
+					if metas, aErr := mc.All(); aErr == nil {
+						row[0] += readIrodsKeyChain(metas)
+					}
+				}
+			}
+		}
+		if strings.HasPrefix(row[0], prefix) {
+			expanded = append(expanded, row)
+		}
+	}
+	return expanded
+}
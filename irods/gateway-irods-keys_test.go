@@ -0,0 +1,64 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+func TestSplitIrodsKey(t *testing.T) {
+	testCases := []struct {
+		value string
+		limit int
+		parts []string
+	}{
+		{"", 4, []string{""}},
+		{"abc", 4, []string{"abc"}},
+		{"abcd", 4, []string{"abcd"}},
+		{"abcde", 4, []string{"abcd", "e"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// Multi-byte characters are never split
+		{"abcdé", 4, []string{"abcd", "é"}},
+		{"abcé", 4, []string{"abc", "é"}},
+		{"ab日本", 4, []string{"ab", "日", "本"}},
+		{"日本語", 6, []string{"日本", "語"}},
+		{"日本語", 5, []string{"日", "本", "語"}},
+	}
+
+	for i, testCase := range testCases {
+		parts := splitIrodsKey(testCase.value, testCase.limit)
+		if !reflect.DeepEqual(parts, testCase.parts) {
+			t.Errorf("Test %d: splitIrodsKey(%q, %d) = %q, expected %q", i+1, testCase.value, testCase.limit, parts, testCase.parts)
+		}
+		if joined := strings.Join(parts, ""); joined != testCase.value {
+			t.Errorf("Test %d: parts of %q join to %q", i+1, testCase.value, joined)
+		}
+	}
+}
+
+func TestCheckObjectKey(t *testing.T) {
+	testCases := []struct {
+		object string
+		err    error
+	}{
+		{"a", nil},
+		{strings.Repeat("a", irodsS3MaxKeyLength), nil},
+		{strings.Repeat("a", irodsS3MaxKeyLength+1), minio.ObjectNameTooLong{}},
+		// The limit is in bytes, not characters
+		{strings.Repeat("é", irodsS3MaxKeyLength/2), nil},
+		{strings.Repeat("é", irodsS3MaxKeyLength/2+1), minio.ObjectNameTooLong{}},
+	}
+
+	for i, testCase := range testCases {
+		err := checkObjectKey("bucket", testCase.object)
+		if reflect.TypeOf(err) != reflect.TypeOf(testCase.err) {
+			t.Errorf("Test %d: checkObjectKey of a %d byte key returned %v, expected %T", i+1, len(testCase.object), err, testCase.err)
+		}
+	}
+}
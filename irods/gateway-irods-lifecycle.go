@@ -0,0 +1,537 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+	"github.com/minio/minio/pkg/lifecycle"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+const (
+	irodsLifecycleObjectName    = "lifecycle_v1_irods.xml"
+	irodsLifecycleLeaseMetaAttr = "minio_lifecycle_lease"
+	irodsStorageClassMetaAttr   = "minio_storage_class"
+	amzStorageClass             = "X-Amz-Storage-Class"
+	irodsTagMetaAttrPrefix      = "minio_tag_"
+	amzTagging                  = "X-Amz-Tagging"
+	irodsLifecycleEnabled       = "Enabled"
+)
+
+// irodsLifecycleConfig is the subset of the S3 lifecycle configuration
+// evaluated by the gateway's lifecycle scheduler. It is decoded from the XML
+// stored in each bucket's lifecycle_v1_irods.xml data object.
+type irodsLifecycleConfig struct {
+	XMLName xml.Name             `xml:"LifecycleConfiguration"`
+	Rules   []irodsLifecycleRule `xml:"Rule"`
+}
+
+type irodsLifecycleTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type irodsLifecycleFilter struct {
+	Prefix string             `xml:"Prefix"`
+	Tag    *irodsLifecycleTag `xml:"Tag"`
+	And    *struct {
+		Prefix string              `xml:"Prefix"`
+		Tags   []irodsLifecycleTag `xml:"Tag"`
+	} `xml:"And"`
+}
+
+type irodsLifecycleRule struct {
+	ID         string               `xml:"ID"`
+	Status     string               `xml:"Status"`
+	Prefix     string               `xml:"Prefix"`
+	Filter     irodsLifecycleFilter `xml:"Filter"`
+	Expiration *struct {
+		Days int    `xml:"Days"`
+		Date string `xml:"Date"`
+	} `xml:"Expiration"`
+	Transition *struct {
+		Days         int    `xml:"Days"`
+		Date         string `xml:"Date"`
+		StorageClass string `xml:"StorageClass"`
+	} `xml:"Transition"`
+	AbortIncompleteMultipartUpload *struct {
+		DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+	} `xml:"AbortIncompleteMultipartUpload"`
+}
+
+// Returns the key prefix a rule applies to, from either the legacy
+// top level Prefix or the Filter element.
+func (r irodsLifecycleRule) prefix() string {
+	if r.Filter.And != nil {
+		return r.Filter.And.Prefix
+	}
+	if r.Filter.Prefix != "" {
+		return r.Filter.Prefix
+	}
+	return r.Prefix
+}
+
+// Returns the tags an object must carry for the rule to apply.
+func (r irodsLifecycleRule) tags() []irodsLifecycleTag {
+	if r.Filter.And != nil {
+		return r.Filter.And.Tags
+	}
+	if r.Filter.Tag != nil {
+		return []irodsLifecycleTag{*r.Filter.Tag}
+	}
+	return nil
+}
+
+// Returns the time after which objects modified at modTime expire, or the zero
+// time if the rule has no expiration.
+func (r irodsLifecycleRule) expiresAt(modTime time.Time) time.Time {
+	if r.Expiration == nil {
+		return time.Time{}
+	}
+	return getIrodsLifecycleTime(modTime, r.Expiration.Days, r.Expiration.Date)
+}
+
+// Returns the time after which objects modified at modTime move to the
+// transition storage class, or the zero time if the rule has no transition.
+func (r irodsLifecycleRule) transitionAt(modTime time.Time) time.Time {
+	if r.Transition == nil {
+		return time.Time{}
+	}
+	return getIrodsLifecycleTime(modTime, r.Transition.Days, r.Transition.Date)
+}
+
+// Returns the time an action with the given Days or Date applies to objects
+// modified at modTime, or the zero time if neither is set or date is invalid.
+func getIrodsLifecycleTime(modTime time.Time, days int, date string) time.Time {
+	if date != "" {
+		t, err := parseIrodsLifecycleDate(date)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	if days > 0 {
+		return modTime.AddDate(0, 0, days)
+	}
+	return time.Time{}
+}
+
+// Parses a lifecycle Date, which S3 clients send as an ISO 8601 timestamp at
+// midnight UTC such as "2019-01-01T00:00:00.000Z", or as a plain date.
+func parseIrodsLifecycleDate(date string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid lifecycle date %v", date)
+}
+
+// Parses the S3 storage class to iRODS resource mapping, given as
+// "CLASS=resource;CLASS2=resource2". Unmapped classes are used as resource
+// names directly.
+func parseIrodsStorageClasses(classes string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(classes, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			continue
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m
+}
+
+func (a *irodsObjects) getStorageClassResource(class string) string {
+	if resc, ok := a.storageClasses[class]; ok {
+		return resc
+	}
+	return class
+}
+
+// SetBucketLifecycle - stores the lifecycle configuration in the bucket collection.
+func (a *irodsObjects) SetBucketLifecycle(ctx context.Context, bucket string, lc *lifecycle.Lifecycle) error {
+	data, err := xml.Marshal(lc)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return err
+	}
+
+	// Replace any existing configuration
+	if rodsObj, oErr := a.getLifecycleObject(bucket); oErr == nil {
+		if dErr := rodsObj.Destroy(); dErr != nil {
+			return irodsToObjectError(dErr, bucket)
+		}
+	}
+
+	rodsObj, cErr := a.createRodsObj(bucket, irodsLifecycleObjectName)
+	if cErr != nil {
+		logger.LogIf(ctx, cErr)
+		return irodsToObjectError(cErr, bucket)
+	}
+
+	return irodsToObjectError(rodsObj.Write(data), bucket)
+}
+
+// GetBucketLifecycle - reads the lifecycle configuration from the bucket collection.
+func (a *irodsObjects) GetBucketLifecycle(ctx context.Context, bucket string) (*lifecycle.Lifecycle, error) {
+	rodsObj, oErr := a.getLifecycleObject(bucket)
+	if oErr != nil {
+		return nil, minio.BucketLifecycleNotFound{Bucket: bucket}
+	}
+
+	data, rErr := rodsObj.Read()
+	if rErr != nil {
+		logger.LogIf(ctx, rErr)
+		return nil, irodsToObjectError(rErr, bucket)
+	}
+
+	return lifecycle.ParseLifecycleConfig(bytes.NewReader(data))
+}
+
+// DeleteBucketLifecycle - removes the lifecycle configuration from the bucket collection.
+func (a *irodsObjects) DeleteBucketLifecycle(ctx context.Context, bucket string) error {
+	rodsObj, oErr := a.getLifecycleObject(bucket)
+	if oErr != nil {
+		return minio.BucketLifecycleNotFound{Bucket: bucket}
+	}
+
+	return irodsToObjectError(rodsObj.Destroy(), bucket)
+}
+
+func (a *irodsObjects) getLifecycleObject(bucket string) (*gorods.DataObj, error) {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+	return col.Con().DataObject(col.Path() + "/" + bucket + "/" + irodsLifecycleObjectName)
+}
+
+// Reads the stored lifecycle rules of a bucket. Returns nil if the bucket has
+// no lifecycle configuration.
+func (a *irodsObjects) getLifecycleConfig(bucket string) (*irodsLifecycleConfig, error) {
+	rodsObj, oErr := a.getLifecycleObject(bucket)
+	if oErr != nil {
+		return nil, nil
+	}
+
+	data, rErr := rodsObj.Read()
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	var config irodsLifecycleConfig
+	if xErr := xml.Unmarshal(data, &config); xErr != nil {
+		return nil, xErr
+	}
+
+	return &config, nil
+}
+
+// Stores the X-Amz-Tagging request header as minio_tag_<key> AVUs, which is
+// what lifecycle tag filters match against.
+func applyIrodsObjectTags(obj *gorods.DataObj, userDefined map[string]string) error {
+	tagging, ok := getUserDefined(userDefined, amzTagging)
+	if !ok || tagging == "" {
+		return nil
+	}
+
+	tags, err := url.ParseQuery(tagging)
+	if err != nil {
+		return err
+	}
+
+	for k, vals := range tags {
+		for _, v := range vals {
+			if _, mErr := obj.AddMeta(gorods.Meta{
+				irodsTagMetaAttrPrefix + k, v, "", nil,
+			}); mErr != nil {
+				return mErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the object carries every tag required by the rule.
+func irodsObjectHasTags(obj *gorods.DataObj, tags []irodsLifecycleTag) (bool, error) {
+	if len(tags) == 0 {
+		return true, nil
+	}
+
+	mc, err := obj.Meta()
+	if err != nil {
+		return false, err
+	}
+	metas, err := mc.All()
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range tags {
+		found := false
+		for _, m := range metas {
+			if m.Attribute == irodsTagMetaAttrPrefix+tag.Key && m.Value == tag.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// runLifecycle evaluates the lifecycle rules of every bucket each
+// lifecycleInterval until the gateway shuts down.
+func (a *irodsObjects) runLifecycle() {
+	if a.lifecycleInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.lifecycleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.lifecycleOnce(context.Background())
+		}
+	}
+}
+
+func (a *irodsObjects) lifecycleOnce(ctx context.Context) {
+	buckets, err := a.ListBuckets(ctx)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return
+	}
+
+	// Limit the rate of catalog changes made by the scheduler
+	throttle := time.NewTicker(time.Second / time.Duration(a.lifecycleRate))
+	defer throttle.Stop()
+
+	for _, bucket := range buckets {
+		config, cErr := a.getLifecycleConfig(bucket.Name)
+		if cErr != nil {
+			logger.LogIf(ctx, fmt.Errorf("Unable to read lifecycle configuration of %v: %v", bucket.Name, cErr))
+			continue
+		}
+		if config == nil {
+			continue
+		}
+
+		// Only one gateway instance processes a bucket at a time
+		if !a.acquireBucketLease(ctx, bucket.Name, irodsLifecycleLeaseMetaAttr, 2*a.lifecycleInterval) {
+			continue
+		}
+
+		for _, rule := range config.Rules {
+			if rule.Status != irodsLifecycleEnabled {
+				continue
+			}
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			logger.LogIf(ctx, a.applyLifecycleRule(ctx, bucket.Name, rule, throttle.C))
+		}
+	}
+}
+
+// Takes a time limited lease stored as attr on the bucket collection so that
+// several gateway instances serving the same zone don't process a bucket
+// concurrently.
+func (a *irodsObjects) acquireBucketLease(ctx context.Context, bucket, attr string, duration time.Duration) bool {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	bucketCol, err := col.Con().Collection(gorods.CollectionOptions{
+		Path: col.Path() + "/" + bucket,
+	})
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return false
+	}
+
+	now := time.Now()
+	heldByOther := func() (bool, error) {
+		leases, lErr := bucketCol.Attribute(attr)
+		if lErr != nil {
+			// No lease attribute present
+			return false, nil
+		}
+		for _, lease := range leases {
+			expiry, pErr := parseIrodsTimestamp(lease.Units)
+			if pErr != nil || expiry.Before(now) {
+				continue
+			}
+			if lease.Value != a.instanceID {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if held, _ := heldByOther(); held {
+		return false
+	}
+
+	bucketCol.DeleteMeta(attr)
+	expiry := now.Add(duration).Unix()
+	if _, mErr := bucketCol.AddMeta(gorods.Meta{
+		attr, a.instanceID, strconv.FormatInt(expiry, 10), nil,
+	}); mErr != nil {
+		logger.LogIf(ctx, mErr)
+		return false
+	}
+
+	// Another instance may have raced us between the check and the write
+	held, _ := heldByOther()
+	return !held
+}
+
+func (a *irodsObjects) applyLifecycleRule(ctx context.Context, bucket string, rule irodsLifecycleRule, throttle <-chan time.Time) error {
+	now := time.Now()
+
+	if rule.Expiration != nil || rule.Transition != nil {
+		objs, qErr := a.queryObjects(bucket, rule.prefix())
+		if qErr != nil {
+			return qErr
+		}
+
+		for _, blob := range objs {
+			blobName := blob[0]
+			blobUnixTime, _ := strconv.ParseInt(blob[1], 10, 64)
+			blobModTime := time.Unix(blobUnixTime, 0)
+
+			expires := rule.expiresAt(blobModTime)
+			expired := !expires.IsZero() && now.After(expires)
+			transitions := rule.transitionAt(blobModTime)
+			transition := !transitions.IsZero() && now.After(transitions)
+			if !expired && !transition {
+				continue
+			}
+
+			rodsObj, oErr := a.getObjectInBucket(bucket, blobName)
+			if oErr != nil {
+				continue
+			}
+			if ok, tErr := irodsObjectHasTags(rodsObj, rule.tags()); tErr != nil || !ok {
+				continue
+			}
+
+			<-throttle
+			if expired {
+				if dErr := a.DeleteObject(ctx, bucket, blobName); dErr != nil {
+					logger.LogIf(ctx, fmt.Errorf("Lifecycle rule %v unable to expire %v/%v: %v", rule.ID, bucket, blobName, dErr))
+				}
+				continue
+			}
+			logger.LogIf(ctx, a.transitionObject(bucket, blobName, rodsObj, rule.Transition.StorageClass))
+		}
+	}
+
+	if rule.AbortIncompleteMultipartUpload != nil {
+		cutoff := now.AddDate(0, 0, -rule.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+		return a.abortStaleUploads(ctx, bucket, rule.prefix(), cutoff, throttle)
+	}
+
+	return nil
+}
+
+// Moves an object to the resource backing storageClass by replicating it there
+// and trimming the original replica.
+func (a *irodsObjects) transitionObject(bucket, object string, obj *gorods.DataObj, storageClass string) error {
+	// The cached ObjectInfo holds the old storage class
+	defer a.invalidateObject(bucket, object)
+
+	if metas, err := obj.Attribute(irodsStorageClassMetaAttr); err == nil {
+		for _, m := range metas {
+			if m.Value == storageClass {
+				return nil
+			}
+		}
+	}
+
+	srcResc := obj.Resource()
+	destResc := a.getStorageClassResource(storageClass)
+	if srcResc != nil && srcResc.Name() == destResc {
+		return nil
+	}
+
+	if err := obj.Replicate(destResc, gorods.DataObjOptions{}); err != nil {
+		return err
+	}
+
+	if srcResc != nil {
+		if err := obj.TrimRepls(gorods.TrimOptions{
+			NumCopiesKeep:  1,
+			TargetResource: srcResc.Name(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	obj.DeleteMeta(irodsStorageClassMetaAttr)
+	_, err := obj.AddMeta(gorods.Meta{
+		irodsStorageClassMetaAttr, storageClass, "", nil,
+	})
+	return err
+}
+
+// Aborts multipart uploads under prefix which were initiated before cutoff.
+func (a *irodsObjects) abortStaleUploads(ctx context.Context, bucket, prefix string, cutoff time.Time, throttle <-chan time.Time) error {
+	markers, err := a.queryUploadMarkers(bucket)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range markers {
+		if m.ModTime.After(cutoff) {
+			continue
+		}
+
+		col := a.GetCol()
+		marker, oErr := col.Con().DataObject(a.colPath + "/" + bucket + "/" + m.Name)
+		a.ReturnCol(col)
+		if oErr != nil {
+			continue
+		}
+
+		// The object key is only known from the upload's metadata
+		var mp irodsMultipartMetadata
+		data, rErr := marker.Read()
+		if rErr != nil || json.Unmarshal(data, &mp) != nil || mp.Name == "" {
+			continue
+		}
+		if !strings.HasPrefix(mp.Name, prefix) {
+			continue
+		}
+
+		<-throttle
+		if aErr := a.AbortMultipartUpload(ctx, bucket, mp.Name, m.UploadID); aErr != nil {
+			logger.LogIf(ctx, fmt.Errorf("Lifecycle unable to abort upload %v of %v/%v: %v", m.UploadID, bucket, mp.Name, aErr))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+const (
+	irodsLockModeMetaAttr    = "minio_lock_mode"
+	irodsLockUntilMetaAttr   = "minio_lock_until"
+	irodsLegalHoldMetaAttr   = "minio_legal_hold"
+	irodsLockModeGovernance  = "GOVERNANCE"
+	irodsLockModeCompliance  = "COMPLIANCE"
+	irodsLegalHoldOn         = "ON"
+	irodsLegalHoldOff        = "OFF"
+	amzObjectLockMode        = "X-Amz-Object-Lock-Mode"
+	amzObjectLockRetainUntil = "X-Amz-Object-Lock-Retain-Until-Date"
+	amzObjectLockLegalHold   = "X-Amz-Object-Lock-Legal-Hold"
+	irodsIsysmeta            = "isysmeta"
+)
+
+// irodsObjectLock is the S3 Object Lock state of a single object. It is
+// stored on the data object as the minio_lock_mode, minio_lock_until and
+// minio_legal_hold AVUs.
+type irodsObjectLock struct {
+	Mode        string
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+// IsZero returns true if no retention or legal hold was requested.
+func (l irodsObjectLock) IsZero() bool {
+	return l.Mode == "" && l.RetainUntil.IsZero() && !l.LegalHold
+}
+
+// IsActive returns true if the object may not be deleted or overwritten at now.
+func (l irodsObjectLock) IsActive(now time.Time) bool {
+	if l.LegalHold {
+		return true
+	}
+	return l.Mode != "" && now.Before(l.RetainUntil)
+}
+
+// Looks up a header in minio's user defined metadata regardless of case.
+func getUserDefined(userDefined map[string]string, key string) (string, bool) {
+	if v, ok := userDefined[key]; ok {
+		return v, true
+	}
+	for k, v := range userDefined {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Returns true for the x-amz-object-lock-* headers, which are kept as lock
+// AVUs rather than minio_meta_ metadata.
+func isIrodsObjectLockHeader(key string) bool {
+	return strings.EqualFold(key, amzObjectLockMode) ||
+		strings.EqualFold(key, amzObjectLockRetainUntil) ||
+		strings.EqualFold(key, amzObjectLockLegalHold)
+}
+
+// Parses the x-amz-object-lock-* request headers passed down by minio.
+func parseIrodsObjectLock(bucket, object string, userDefined map[string]string) (lock irodsObjectLock, err error) {
+	if mode, ok := getUserDefined(userDefined, amzObjectLockMode); ok {
+		lock.Mode = strings.ToUpper(mode)
+		if lock.Mode != irodsLockModeGovernance && lock.Mode != irodsLockModeCompliance {
+			return lock, minio.InvalidArgument{
+				Bucket: bucket,
+				Object: object,
+				Err:    fmt.Errorf("Invalid object lock mode %v", mode),
+			}
+		}
+	}
+
+	if until, ok := getUserDefined(userDefined, amzObjectLockRetainUntil); ok {
+		if lock.RetainUntil, err = time.Parse(time.RFC3339, until); err != nil {
+			return lock, minio.InvalidArgument{
+				Bucket: bucket,
+				Object: object,
+				Err:    fmt.Errorf("Invalid object lock retain until date %v", until),
+			}
+		}
+	}
+
+	// Retention mode and date must be given together
+	if (lock.Mode == "") != lock.RetainUntil.IsZero() {
+		return lock, minio.InvalidArgument{
+			Bucket: bucket,
+			Object: object,
+			Err:    fmt.Errorf("Object lock mode and retain until date must be set together"),
+		}
+	}
+
+	if hold, ok := getUserDefined(userDefined, amzObjectLockLegalHold); ok {
+		lock.LegalHold = strings.EqualFold(hold, irodsLegalHoldOn)
+	}
+
+	return lock, nil
+}
+
+// Reads the object lock AVUs of a data object.
+func readIrodsObjectLock(obj *gorods.DataObj) (lock irodsObjectLock, err error) {
+	mc, err := obj.Meta()
+	if err != nil {
+		return lock, err
+	}
+
+	metas, err := mc.All()
+	if err != nil {
+		return lock, err
+	}
+
+	for _, m := range metas {
+		switch m.Attribute {
+		case irodsLockModeMetaAttr:
+			lock.Mode = m.Value
+		case irodsLockUntilMetaAttr:
+			unix, pErr := parseIrodsTimestamp(m.Value)
+			if pErr != nil {
+				return lock, pErr
+			}
+			lock.RetainUntil = unix
+		case irodsLegalHoldMetaAttr:
+			lock.LegalHold = m.Value == irodsLegalHoldOn
+		}
+	}
+
+	return lock, nil
+}
+
+// Parses the unix timestamps we store in AVUs and iRODS uses in the catalog.
+func parseIrodsTimestamp(ts string) (time.Time, error) {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0).UTC(), nil
+}
+
+// checkObjectLock returns minio.PrefixAccessDenied if the object exists and is
+// under retention or legal hold. Missing objects are not locked, any other
+// lookup error is returned so a catalog failure never lifts a lock.
+func (a *irodsObjects) checkObjectLock(ctx context.Context, bucket, object string) error {
+	rodsObj, oErr := a.getObjectInBucket(bucket, object)
+	if _, ok := oErr.(minio.ObjectNotFound); ok {
+		return nil
+	}
+	if oErr != nil {
+		logger.LogIf(ctx, oErr)
+		return oErr
+	}
+
+	lock, lErr := readIrodsObjectLock(rodsObj)
+	if lErr != nil {
+		logger.LogIf(ctx, lErr)
+		return irodsToObjectError(lErr, bucket, object)
+	}
+
+	if lock.IsActive(time.Now()) {
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+	}
+
+	return nil
+}
+
+// detectIsysmeta resolves the isysmeta icommand the retain until date of
+// locked objects is copied to the catalog with.
+func (a *irodsObjects) detectIsysmeta() {
+	if a.isysmeta == "" {
+		return
+	}
+	if isysmeta, err := exec.LookPath(a.isysmeta); err == nil {
+		a.isysmeta = isysmeta
+	} else {
+		logger.Info("%v not found, the expiry of locked data objects is only kept in %v AVUs", a.isysmeta, irodsLockUntilMetaAttr)
+		a.isysmeta = ""
+	}
+}
+
+// applyObjectLock stores the lock state as AVUs on the data object. Write
+// access is dropped by sealRodsObj once the object has been committed.
+//
+// The retain until date is also set as the data object's expiry,
+// R_DATA_MAIN.data_expiry_ts, with "isysmeta mod" as GoRODS doesn't expose
+// rcModDataObjMeta. minio_lock_until stays authoritative for the gateway.
+func (a *irodsObjects) applyObjectLock(ctx context.Context, obj *gorods.DataObj, lock irodsObjectLock) error {
+	if lock.IsZero() {
+		return nil
+	}
+
+	if lock.Mode != "" {
+		if _, err := obj.AddMeta(gorods.Meta{
+			irodsLockModeMetaAttr, lock.Mode, "", nil,
+		}); err != nil {
+			return err
+		}
+		until := strconv.FormatInt(lock.RetainUntil.Unix(), 10)
+		if _, err := obj.AddMeta(gorods.Meta{
+			irodsLockUntilMetaAttr, until, "", nil,
+		}); err != nil {
+			return err
+		}
+		if a.isysmeta != "" {
+			out, err := a.irodsICommand(ctx, a.isysmeta, "mod", obj.Path(), until).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v mod %v: %v: %s", a.isysmeta, obj.Path(), err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+
+	hold := irodsLegalHoldOff
+	if lock.LegalHold {
+		hold = irodsLegalHoldOn
+	}
+	_, err := obj.AddMeta(gorods.Meta{
+		irodsLegalHoldMetaAttr, hold, "", nil,
+	})
+	return err
+}
+
+// sealRodsObj downgrades every write or own permission on a committed object
+// under lock to read, the gateway user's included: icommands users often log
+// in with the gateway account. Ownership goes to the lock account if one is
+// configured, it hands it back once the lock has expired. Objects sealed
+// without one stay read only until a rodsadmin restores access.
+func (a *irodsObjects) sealRodsObj(obj *gorods.DataObj, lock irodsObjectLock) error {
+	if lock.IsZero() {
+		return nil
+	}
+
+	if a.lockConOpts != nil {
+		if err := obj.Chmod(a.lockConOpts.Username, gorods.Own, false); err != nil {
+			return err
+		}
+	}
+
+	acls, err := obj.ACL()
+	if err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if acl.AccessLevel < gorods.Write {
+			continue
+		}
+		name := acl.AccessObject.Name()
+		if name == a.user || (a.lockConOpts != nil && name == a.lockConOpts.Username) {
+			continue
+		}
+		if cErr := obj.Chmod(name, gorods.Read, false); cErr != nil {
+			return cErr
+		}
+	}
+
+	// Last, the gateway user needs own to change the others
+	return obj.Chmod(a.user, gorods.Read, false)
+}
+
+// reclaimRodsObj has the lock account give the gateway user back ownership of
+// a sealed object whose lock has expired, so it can be deleted or overwritten.
+func (a *irodsObjects) reclaimRodsObj(obj *gorods.DataObj) error {
+	acls, err := obj.ACL()
+	if err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if acl.AccessObject.Name() == a.user && acl.AccessLevel >= gorods.Own {
+			return nil
+		}
+	}
+	if a.lockConOpts == nil {
+		return fmt.Errorf("%v is read only since it was locked, no lock account is configured to reclaim it", obj.Path())
+	}
+
+	rodsCon, err := gorods.NewConnection(a.lockConOpts)
+	if err != nil {
+		return err
+	}
+	defer rodsCon.Disconnect()
+
+	lockObj, err := rodsCon.DataObject(obj.Path())
+	if err != nil {
+		return err
+	}
+	return lockObj.Chmod(a.user, gorods.Own, false)
+}
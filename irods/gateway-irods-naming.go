@@ -0,0 +1,96 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	gorods "github.com/jjacquay712/GoRODS"
+)
+
+// Object data is stored in a data object named after a hash of the key, as
+// data_name is too short for S3 keys. The hash is chosen with
+// MINIO_IRODS_OBJECT_NAMING, objects written with any of them are found.
+const irodsObjectNamingDefault = "sha256"
+
+var irodsObjectNamings = map[string]func(string) string{
+	"sha256": getSHA256Hash,
+	"md5":    getMD5Hash,
+}
+
+func getSHA256Hash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// Validates the MINIO_IRODS_OBJECT_NAMING setting.
+func parseIrodsObjectNaming(naming string) (string, error) {
+	if naming == "" {
+		return irodsObjectNamingDefault, nil
+	}
+	naming = strings.ToLower(naming)
+	if _, ok := irodsObjectNamings[naming]; !ok {
+		return "", fmt.Errorf("Unknown object naming %v", naming)
+	}
+	return naming, nil
+}
+
+// getObjectName returns the data object name new data for object is written to.
+func (a *irodsObjects) getObjectName(object string) string {
+	return irodsObjectNamings[a.objectNaming](object)
+}
+
+// Returns the names object may be stored under, the configured one first.
+func (a *irodsObjects) getObjectNames(object string) []string {
+	names := []string{a.getObjectName(object)}
+	for naming, hashFn := range irodsObjectNamings {
+		if naming != a.objectNaming {
+			names = append(names, hashFn(object))
+		}
+	}
+	return names
+}
+
+// Returns true if name is a data object name object may be stored under.
+func isIrodsObjectName(name, object string) bool {
+	for _, hashFn := range irodsObjectNamings {
+		if hashFn(object) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getRodsObjKey returns the key obj is indexed under in bucket, including any
+// part continued in minio_key_cont AVUs.
+func getRodsObjKey(obj *gorods.DataObj, bucket string) (string, bool) {
+	mc, err := obj.Meta()
+	if err != nil {
+		return "", false
+	}
+	metas, err := mc.All()
+	if err != nil {
+		return "", false
+	}
+
+	for _, m := range metas {
+		switch m.Attribute {
+		case irodsKeyMetaAttr:
+			if m.Units == bucket {
+				return m.Value + readIrodsKeyChain(metas), true
+			}
+		case irodsObjMetaAttr:
+			for _, sep := range irodsLegacyKeySeparators {
+				if strings.HasPrefix(m.Value, bucket+sep) {
+					return strings.TrimPrefix(m.Value, bucket+sep) + readIrodsKeyChain(metas), true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,189 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// Listings without a delimiter are read a page at a time, starting after the
+// marker, so each ListObjects call costs about maxKeys rows of catalog work
+// instead of every key below the prefix. Keys are compared byte by byte like
+// the gateway does, whatever the collation of the catalog database.
+//
+// irodsListKeysPageQuery pages through the minio_key index:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// AND R_META_MAIN.meta_attr_value COLLATE "C" > ?
+// ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?
+//
+// irodsListObjectsPageQuery pages through minio_obj AVUs:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// AND R_META_MAIN.meta_attr_value COLLATE "C" > ?
+// ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?
+const (
+	irodsListKeysPageQuery    = "minio_list_keys_page_v2"
+	irodsListObjectsPageQuery = "minio_list_objects_page_v2"
+)
+
+// detectPagedQueries enables paged listings if the page queries for every
+// index in use are installed.
+func (a *irodsObjects) detectPagedQueries() {
+	if a.genQuery {
+		return
+	}
+
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	if a.keyIndex {
+		if _, err := col.Con().IQuestSQL(irodsListKeysPageQuery, irodsKeyMetaAttr, "", "", "", "1"); err != nil {
+			logger.Info("Specific query %v is not installed, listings read every key below the prefix", irodsListKeysPageQuery)
+			return
+		}
+	}
+	if a.legacyIndex {
+		if _, err := col.Con().IQuestSQL(irodsListObjectsPageQuery, irodsObjMetaAttr, "", "", "1"); err != nil {
+			logger.Info("Specific query %v is not installed, listings read every key below the prefix", irodsListObjectsPageQuery)
+			return
+		}
+	}
+	a.pagedQueries = true
+}
+
+// canListPaged returns true if the catalog can start a listing below prefix
+// after marker. Keys and markers longer than the part of a key held by its
+// index AVU can't be compared by the catalog.
+func (a *irodsObjects) canListPaged(bucket, prefix, marker string) bool {
+	n := a.indexedKeyLength(bucket)
+	return a.pagedQueries && len(prefix) < n && len(marker) < n
+}
+
+// irodsIndexPage is a result of queryIndexPage, passed back by retryIrods.
+type irodsIndexPage struct {
+	rows [][]string
+	next string
+	more bool
+}
+
+// queryIndexPage returns up to limit rows per index of the keys in bucket
+// starting with prefix and sorting after marker. Rows are cut off at the
+// last key every index has been read up to, which is returned as the marker
+// for the next page, with more set if there may be rows after it.
+func (a *irodsObjects) queryIndexPage(bucket, prefix, marker string, limit int) (rows [][]string, next string, more bool, err error) {
+	return a.queryIndexSourcesPage(bucket, prefix, marker, limit, a.keyIndex, a.legacyIndex)
+}
+
+// queryIndexSourcesPage is queryIndexPage restricted to the minio_key index
+// if keyIndex is set and the minio_obj index if legacyIndex is set.
+func (a *irodsObjects) queryIndexSourcesPage(bucket, prefix, marker string, limit int, keyIndex, legacyIndex bool) (rows [][]string, next string, more bool, err error) {
+	var sources [][][]string
+
+	col := a.GetCol()
+	if keyIndex {
+		keyRows, qErr := col.Con().IQuestSQL(irodsListKeysPageQuery,
+			irodsKeyMetaAttr, bucket, escapeIrodsLike(prefix)+"%", marker, strconv.Itoa(limit))
+		if qErr != nil {
+			a.ReturnCol(col)
+			return nil, "", false, qErr
+		}
+		sources = append(sources, keyRows)
+	}
+	if legacyIndex {
+		for _, sep := range irodsLegacyKeySeparators {
+			legacyRows, qErr := col.Con().IQuestSQL(irodsListObjectsPageQuery,
+				irodsObjMetaAttr, escapeIrodsLike(bucket+sep+prefix)+"%", bucket+sep+marker, strconv.Itoa(limit))
+			if qErr != nil {
+				a.ReturnCol(col)
+				return nil, "", false, qErr
+			}
+			sources = append(sources, trimIrodsLegacyKeys(legacyRows, bucket+sep))
+		}
+	}
+	a.ReturnCol(col)
+
+	// An index which filled its page may hold more keys before the last one
+	// another index returned
+	for _, source := range sources {
+		if len(source) < limit {
+			continue
+		}
+		if last := source[len(source)-1][0]; !more || last < next {
+			next = last
+		}
+		more = true
+	}
+
+	for _, source := range sources {
+		for _, row := range source {
+			if more && row[0] > next {
+				break
+			}
+			rows = append(rows, row)
+		}
+	}
+	return sortIrodsObjectRows(rows), next, more, nil
+}
+
+// listObjectsPaged implements ListObjects without a delimiter on top of
+// queryIndexPage.
+func (a *irodsObjects) listObjectsPaged(ctx context.Context, bucket, bucketPath, prefix, marker string, maxKeys int) (result minio.ListObjectsInfo, err error) {
+	if maxKeys <= 0 {
+		return result, nil
+	}
+	if isIrodsMarker(marker) {
+		marker = ""
+	}
+
+	after := marker
+	for {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		val, qErr := a.retryIrods(func() (interface{}, error) {
+			rows, next, more, pErr := a.queryIndexPage(bucket, prefix, after, maxKeys+1-len(result.Objects))
+			return irodsIndexPage{rows, next, more}, pErr
+		})
+		if qErr != nil {
+			return result, irodsToObjectError(irodsBackendError(qErr, fmt.Errorf("Error occured listing objects in %v", bucket)), bucket, prefix)
+		}
+
+		page := val.(irodsIndexPage)
+
+		for _, row := range dedupeIrodsObjectRows(sortIrodsObjectRows(a.expandObjectKeys(bucket, prefix, page.rows))) {
+			if row[0] <= marker || isIrodsSysTmp(row[0], prefix) {
+				continue
+			}
+			if n := len(result.Objects); n > 0 && result.Objects[n-1].Name == row[0] {
+				continue
+			}
+			if len(result.Objects) == maxKeys {
+				result.IsTruncated = true
+				result.NextMarker = result.Objects[maxKeys-1].Name
+				return result, nil
+			}
+			if err = ctx.Err(); err != nil {
+				return result, err
+			}
+			result.Objects = append(result.Objects, a.rowObjectInfo(ctx, bucket, bucketPath, row))
+		}
+
+		if !page.more {
+			return result, nil
+		}
+		after = page.next
+	}
+}
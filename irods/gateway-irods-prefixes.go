@@ -0,0 +1,380 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/cli"
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// With MINIO_IRODS_PREFIX_INDEX on, '/' delimited listings read only the
+// entries directly below their prefix:
+//
+// Every folder, a prefix of a key ending in '/', is mirrored as a collection
+// below the prefixes collection of the bucket, so the common prefixes of a
+// listing are the subcollections of its prefix.
+//
+// Every object has a minio_level_N AVU holding its key, with the bucket in
+// its units, where N is the number of '/' in the key. The objects directly
+// below a prefix are the keys starting with it at the same level.
+//
+// Folders that can't be mirrored, like "a/./" or "a//", mark the deepest
+// collection mirroring their parents with a minio_prefix_irregular AVU and
+// are listed without the index. A bucket is listed through the index once
+// its prefixes collection carries minio_prefix_index, set when the bucket is
+// created or by the build-prefix-index subcommand.
+const (
+	irodsPrefixSubCol             = "prefixes"
+	irodsLevelMetaAttrPrefix      = "minio_level_"
+	irodsPrefixIndexMetaAttr      = "minio_prefix_index"
+	irodsPrefixIrregularMetaAttr  = "minio_prefix_irregular"
+	irodsMaxCollectionPath        = 1024
+	irodsPrefixDelimiter          = "/"
+	irodsPrefixIndexCompleteValue = "complete"
+)
+
+// Returns the minio_level_N attribute of key. For a folder it is the one of
+// the keys directly below it.
+func getIrodsLevelMetaAttr(key string) string {
+	return irodsLevelMetaAttrPrefix + strconv.Itoa(strings.Count(key, irodsPrefixDelimiter))
+}
+
+// Returns every prefix of key ending in '/', shortest first.
+func getIrodsFolders(key string) []string {
+	var folders []string
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' {
+			folders = append(folders, key[:i+1])
+		}
+	}
+	return folders
+}
+
+// Returns true if folder can be mirrored by a collection.
+func isIrodsMirrorable(folder string) bool {
+	if folder == "" {
+		return true
+	}
+	for _, name := range strings.Split(strings.TrimSuffix(folder, irodsPrefixDelimiter), irodsPrefixDelimiter) {
+		if name == "" || name == "." || name == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the path of the collection mirroring folder in bucket.
+func (a *irodsObjects) getPrefixColPath(bucket, folder string) string {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	prefixColPath := col.Path() + "/" + bucket + "/" + irodsPrefixSubCol
+	if folder != "" {
+		prefixColPath += "/" + strings.TrimSuffix(folder, irodsPrefixDelimiter)
+	}
+	return prefixColPath
+}
+
+// Returns the subcollection name of parent, creating it if needed. Another
+// gateway may create it at the same time.
+func (a *irodsObjects) ensureSubCollection(parent *gorods.Collection, name string) (*gorods.Collection, error) {
+	if sub, err := a.getCollection(parent.Path() + "/" + name); err == nil {
+		return sub, nil
+	}
+	if sub, err := parent.CreateSubCollection(name); err == nil {
+		return sub, nil
+	}
+	return a.getCollection(parent.Path() + "/" + name)
+}
+
+// Marks col as mirroring a folder with folders below it that aren't mirrored.
+func markIrodsPrefixIrregular(col *gorods.Collection) error {
+	if metas, _ := col.Attribute(irodsPrefixIrregularMetaAttr); len(metas) > 0 {
+		return nil
+	}
+	_, err := col.AddMeta(gorods.Meta{
+		irodsPrefixIrregularMetaAttr, "true", "", nil,
+	})
+	return err
+}
+
+// detectPrefixIndex turns the prefix index off unless objects are indexed by
+// minio_key AVUs, the level AVUs are listed with the same specific queries.
+func (a *irodsObjects) detectPrefixIndex() {
+	if a.prefixIndex && !a.keyIndex {
+		logger.Info("Specific query %v is not installed, folders are not mirrored as collections", irodsStatKeyQuery)
+		a.prefixIndex = false
+	}
+}
+
+// initPrefixIndex creates the prefixes collection of a new bucket, which
+// starts out indexed. Only called with the prefix index, and so the minio_key
+// index, in use.
+func (a *irodsObjects) initPrefixIndex(bucketCol *gorods.Collection) error {
+	prefixCol, err := bucketCol.CreateSubCollection(irodsPrefixSubCol)
+	if err != nil {
+		return err
+	}
+	_, err = prefixCol.AddMeta(gorods.Meta{
+		irodsPrefixIndexMetaAttr, irodsPrefixIndexCompleteValue, "", nil,
+	})
+	return err
+}
+
+// Creates the collections mirroring the folders of key in bucket and returns
+// the deepest one, marked irregular if key has folders below it that can't
+// be mirrored.
+func (a *irodsObjects) ensurePrefixCols(bucket, key string) (*gorods.Collection, error) {
+	col, err := a.getCollection(a.getPrefixColPath(bucket, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, folder := range getIrodsFolders(key) {
+		name := path.Base(folder)
+		if !isIrodsMirrorable(folder) || len(col.Path())+len(name)+1 > irodsMaxCollectionPath {
+			return col, markIrodsPrefixIrregular(col)
+		}
+		if col, err = a.ensureSubCollection(col, name); err != nil {
+			return nil, err
+		}
+	}
+	return col, nil
+}
+
+// addPrefixIndex adds obj holding object in bucket to the prefix index.
+func (a *irodsObjects) addPrefixIndex(obj *gorods.DataObj, bucket, object string) error {
+	if !a.prefixIndex {
+		return nil
+	}
+
+	// A parent removed by removePrefixIndex at the same time is created again
+	col, err := a.ensurePrefixCols(bucket, object)
+	if err != nil {
+		col, err = a.ensurePrefixCols(bucket, object)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keys too long for one AVU are only found by listings without the index
+	if len(object) > a.maxAVUValue {
+		return markIrodsPrefixIrregular(col)
+	}
+	if _, err = obj.AddMeta(gorods.Meta{
+		getIrodsLevelMetaAttr(object), object, bucket, nil,
+	}); err != nil {
+		return err
+	}
+
+	// removePrefixIndex may have found the folder empty before the AVU was
+	// added, either it sees the AVU or the collection is missing here
+	if _, cErr := a.getCollection(col.Path()); cErr != nil {
+		_, err = a.ensurePrefixCols(bucket, object)
+	}
+	return err
+}
+
+// removePrefixIndex removes the collections mirroring folders of object that
+// are empty once it has been deleted. Collections are removed non-recursively,
+// one which a concurrent addPrefixIndex has created a subcollection in is
+// left alone.
+func (a *irodsObjects) removePrefixIndex(bucket, object string) error {
+	if !a.prefixIndex {
+		return nil
+	}
+
+	folders := getIrodsFolders(object)
+	for i := len(folders) - 1; i >= 0; i-- {
+		folder := folders[i]
+		if !isIrodsMirrorable(folder) {
+			continue
+		}
+
+		col, err := a.getCollection(a.getPrefixColPath(bucket, folder))
+		if err != nil {
+			continue
+		}
+		if metas, _ := col.Attribute(irodsPrefixIrregularMetaAttr); len(metas) > 0 {
+			return nil
+		}
+		if subCols, sErr := col.Collections(); sErr != nil || len(subCols) > 0 {
+			return sErr
+		}
+		rows, qErr := a.catalog.queryMetaPrefix(getIrodsLevelMetaAttr(folder), bucket, folder)
+		if qErr != nil || len(rows) > 0 {
+			return qErr
+		}
+		if dErr := col.Delete(false); dErr != nil {
+			return nil
+		}
+
+		// An object added to the folder meanwhile needs it back, see
+		// addPrefixIndex
+		rows, qErr = a.catalog.queryMetaPrefix(getIrodsLevelMetaAttr(folder), bucket, folder)
+		if qErr != nil {
+			return qErr
+		}
+		if len(rows) > 0 {
+			_, err = a.ensurePrefixCols(bucket, folder)
+			return err
+		}
+	}
+	return nil
+}
+
+// canListPrefixIndex returns true if the listing below prefix can be read
+// from the prefix index.
+func (a *irodsObjects) canListPrefixIndex(bucket, prefix string) bool {
+	if !a.prefixIndex || !isIrodsMirrorable(prefix) {
+		return false
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, irodsPrefixDelimiter) {
+		return false
+	}
+
+	rootCol, err := a.getCollection(a.getPrefixColPath(bucket, ""))
+	if err != nil {
+		return false
+	}
+	metas, _ := rootCol.Attribute(irodsPrefixIndexMetaAttr)
+	return len(metas) > 0 && metas[0].Value == irodsPrefixIndexCompleteValue
+}
+
+// listObjectsPrefixIndex implements ListObjects with a '/' delimiter on top
+// of the prefix index, falling back to listObjectsFull below irregular folders.
+func (a *irodsObjects) listObjectsPrefixIndex(ctx context.Context, bucket, bucketPath, prefix, marker string, maxKeys int) (result minio.ListObjectsInfo, err error) {
+	if maxKeys <= 0 {
+		return result, nil
+	}
+	if isIrodsMarker(marker) {
+		marker = ""
+	}
+
+	// A folder without a collection is empty, unless it is below one too
+	// long to mirror
+	col, cErr := a.getCollection(a.getPrefixColPath(bucket, prefix))
+	if isIrodsBackendDown(cErr) {
+		return result, cErr
+	}
+	if cErr != nil {
+		if a.isBelowIrregularPrefix(bucket, prefix) {
+			return a.listObjectsFull(ctx, bucket, bucketPath, prefix, marker, irodsPrefixDelimiter, maxKeys)
+		}
+		return result, nil
+	}
+	if metas, _ := col.Attribute(irodsPrefixIrregularMetaAttr); len(metas) > 0 {
+		return a.listObjectsFull(ctx, bucket, bucketPath, prefix, marker, irodsPrefixDelimiter, maxKeys)
+	}
+
+	val, sErr := a.retryIrods(func() (interface{}, error) {
+		return col.Collections()
+	})
+	if sErr != nil {
+		return result, irodsToObjectError(irodsBackendError(sErr, fmt.Errorf("Error occured listing prefixes in %v", bucket)), bucket, prefix)
+	}
+	subCols := val.([]*gorods.Collection)
+	prefixes := make([]string, 0, len(subCols))
+	for _, subCol := range subCols {
+		prefixes = append(prefixes, prefix+subCol.Name()+irodsPrefixDelimiter)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return result, err
+	}
+	rows, qErr := a.catalog.queryMetaPrefix(getIrodsLevelMetaAttr(prefix), bucket, prefix)
+	if qErr != nil {
+		return result, irodsToObjectError(irodsBackendError(qErr, fmt.Errorf("Error occured listing objects in %v", bucket)), bucket, prefix)
+	}
+	rows = dedupeIrodsObjectRows(sortIrodsObjectRows(rows))
+
+	return a.mergeListing(ctx, bucket, bucketPath, prefix, marker, irodsPrefixDelimiter, maxKeys, prefixes, rows)
+}
+
+// Returns true if the deepest collection mirroring a parent of prefix is
+// marked irregular.
+func (a *irodsObjects) isBelowIrregularPrefix(bucket, prefix string) bool {
+	folders := append([]string{""}, getIrodsFolders(prefix)...)
+	for i := len(folders) - 1; i >= 0; i-- {
+		col, err := a.getCollection(a.getPrefixColPath(bucket, folders[i]))
+		if err != nil {
+			continue
+		}
+		metas, _ := col.Attribute(irodsPrefixIrregularMetaAttr)
+		return len(metas) > 0
+	}
+	return false
+}
+
+// buildPrefixIndex adds every object in bucket to the prefix index and then
+// marks the bucket as indexed. Objects already in it are skipped. Both object
+// indexes are read whatever the gateway is configured to look objects up
+// with, a bucket isn't marked indexed while one of them can't be read.
+func (a *irodsObjects) buildPrefixIndex(bucket string) (indexed int, err error) {
+	if !a.keyIndex {
+		return 0, fmt.Errorf("specific query %v is not installed, objects indexed by %v AVUs can't be listed", irodsStatKeyQuery, irodsKeyMetaAttr)
+	}
+
+	bucketCol, err := a.getBucketCol(bucket)
+	if err != nil {
+		return 0, err
+	}
+	rootCol, err := a.ensureSubCollection(bucketCol, irodsPrefixSubCol)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := a.queryIndexSources(bucket, a.indexedKeyPrefix(bucket, ""), true, true)
+	if err != nil {
+		return 0, err
+	}
+	rows = sortIrodsObjectRows(a.expandObjectKeys(bucket, "", rows))
+	for _, row := range dedupeIrodsObjectRows(rows) {
+		rodsObj, oErr := a.getDataObjInBucket(bucket, row[4])
+		if oErr != nil {
+			return indexed, oErr
+		}
+		if metas, _ := rodsObj.Attribute(getIrodsLevelMetaAttr(row[0])); len(metas) > 0 {
+			continue
+		}
+		if iErr := a.addPrefixIndex(rodsObj, bucket, row[0]); iErr != nil {
+			return indexed, iErr
+		}
+		indexed++
+	}
+
+	if metas, _ := rootCol.Attribute(irodsPrefixIndexMetaAttr); len(metas) > 0 {
+		return indexed, nil
+	}
+	_, err = rootCol.AddMeta(gorods.Meta{
+		irodsPrefixIndexMetaAttr, irodsPrefixIndexCompleteValue, "", nil,
+	})
+	return indexed, err
+}
+
+// Handler for 'minio gateway irods build-prefix-index' command line.
+func irodsBuildPrefixIndexMain(ctx *cli.Context) {
+	a := newIrodsCommandLayer(ctx)
+	defer a.Shutdown(context.Background())
+	a.prefixIndex = true
+
+	buckets, err := a.ListBuckets(context.Background())
+	logger.FatalIf(err, "Unable to list buckets")
+
+	for _, bucket := range buckets {
+		indexed, bErr := a.buildPrefixIndex(bucket.Name)
+		logger.FatalIf(bErr, "Unable to build the prefix index of %v", bucket.Name)
+		fmt.Printf("%v: %d objects indexed\n", bucket.Name, indexed)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"strings"
+	"sync/atomic"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+)
+
+// Specific queries the gateway looks objects up with. All of them return rows
+// of meta_attr_value, modify_ts, data_size, data_checksum and data_name.
+//
+// irodsListQuery:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\'
+// ORDER BY R_META_MAIN.meta_attr_value ASC
+//
+// irodsStatQuery:
+// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
+// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
+// LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
+// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value = ?
+// ORDER BY R_META_MAIN.meta_attr_value ASC
+//
+// Zones which only have the original irodsIQuestQuery installed keep working,
+// its LIKE has no escape character so rows are filtered by the gateway.
+const (
+	irodsListQuery = "minio_list_objects_v2"
+	irodsStatQuery = "minio_stat_object_v1"
+)
+
+// Escapes the LIKE wildcards in s, using the backslash irodsListQuery
+// declares as escape character.
+func escapeIrodsLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// queryMetaPrefix returns the rows for every data object with an attr AVU
+// whose value starts with prefix.
+func (a *irodsObjects) queryMetaPrefix(attr, prefix string) ([][]string, error) {
+	return a.catalog.queryMetaPrefix(attr, "", prefix)
+}
+
+// queryMetaValue returns the rows for every data object with an attr AVU
+// whose value is exactly value.
+func (a *irodsObjects) queryMetaValue(attr, value string) ([][]string, error) {
+	return a.catalog.queryMetaValue(attr, "", value)
+}
+
+// irodsSpecificQueries looks objects up with the gateway's specific queries.
+// AVUs with units are looked up with irodsListKeysQuery and irodsStatKeyQuery.
+type irodsSpecificQueries struct {
+	a *irodsObjects
+}
+
+func (q irodsSpecificQueries) queryMetaPrefix(attr, units, prefix string) ([][]string, error) {
+	col := q.a.GetCol()
+	defer q.a.ReturnCol(col)
+
+	if units != "" {
+		return col.Con().IQuestSQL(irodsListKeysQuery, attr, units, escapeIrodsLike(prefix)+"%")
+	}
+
+	if atomic.LoadInt32(&q.a.legacyQueries) == 0 {
+		rows, err := col.Con().IQuestSQL(irodsListQuery, attr, escapeIrodsLike(prefix)+"%")
+		if err == nil {
+			return rows, nil
+		}
+		if !q.a.useLegacyQueries(col) {
+			return nil, err
+		}
+	}
+
+	rows, err := col.Con().IQuestSQL(irodsIQuestQuery, attr, prefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	filtered := rows[:0]
+	for _, row := range rows {
+		if strings.HasPrefix(row[0], prefix) {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered, nil
+}
+
+func (q irodsSpecificQueries) queryMetaValue(attr, units, value string) ([][]string, error) {
+	col := q.a.GetCol()
+	defer q.a.ReturnCol(col)
+
+	if units != "" {
+		return col.Con().IQuestSQL(irodsStatKeyQuery, attr, units, value)
+	}
+
+	if atomic.LoadInt32(&q.a.legacyQueries) == 0 {
+		rows, err := col.Con().IQuestSQL(irodsStatQuery, attr, value)
+		if err == nil {
+			return rows, nil
+		}
+		if !q.a.useLegacyQueries(col) {
+			return nil, err
+		}
+	}
+
+	rows, err := col.Con().IQuestSQL(irodsIQuestQuery, attr, value)
+	if err != nil {
+		return nil, err
+	}
+	filtered := rows[:0]
+	for _, row := range rows {
+		if row[0] == value {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered, nil
+}
+
+// Called when one of the versioned queries failed. Switches to the original
+// irodsIQuestQuery if that one is installed, so the error was most likely a
+// missing query rather than a catalog failure.
+func (a *irodsObjects) useLegacyQueries(col *gorods.Collection) bool {
+	if _, err := col.Con().IQuestSQL(irodsIQuestQuery, irodsObjMetaAttr, ""); err != nil {
+		return false
+	}
+	if atomic.SwapInt32(&a.legacyQueries, 1) == 0 {
+		logger.Info("Specific queries %v and %v are not installed, falling back to %v", irodsListQuery, irodsStatQuery, irodsIQuestQuery)
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"testing"
+)
+
+func TestEscapeIrodsLike(t *testing.T) {
+	testCases := []struct {
+		s       string
+		escaped string
+	}{
+		{"", ""},
+		{"photos/2018/", "photos/2018/"},
+		{"100%", `100\%`},
+		{"my_file", `my\_file`},
+		{`a\b`, `a\\b`},
+		// The escape character is escaped before the wildcards
+		{`\%_`, `\\\%\_`},
+		{"%%__", `\%\%\_\_`},
+		{"día_año%", `día\_año\%`},
+	}
+
+	for i, testCase := range testCases {
+		if escaped := escapeIrodsLike(testCase.s); escaped != testCase.escaped {
+			t.Errorf("Test %d: escapeIrodsLike(%q) = %q, expected %q", i+1, testCase.s, escaped, testCase.escaped)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+// Catalog queries, collection and data object lookups and AVU reads are
+// retried while iRODS is unreachable, so a catalog restart or a network blip
+// delays requests instead of failing them. GoRODS reports errors as text, so
+// a failure is only retried if a fresh connection to iRODS fails as well,
+// errors iRODS answered with, like a missing object, fail at once. Writes are
+// only retried where repeating them can't change the outcome, and object data
+// isn't retried once it has started streaming.
+//
+// An outage leaves the pooled connections dead, so every connection opened
+// before a failure is replaced the next time it is taken from the pool. A
+// GoRODS call can't be interrupted, one that is still running at the end of
+// MINIO_IRODS_OP_TIMEOUT is abandoned and the pool is topped up with a new
+// connection in place of the one it holds. A call abandoned while iRODS
+// still answers a probe was only slow, it fails with minio.OperationTimedOut
+// and doesn't count as a failure to reach iRODS. Listings read every key
+// below their prefix and get MINIO_IRODS_SCAN_TIMEOUT instead, the gateway's
+// subcommands wait for as long as iRODS takes.
+//
+// After MINIO_IRODS_BREAKER_THRESHOLD failures in a row the breaker opens and
+// requests fail with minio.BackendDown without waiting on iRODS. Once
+// MINIO_IRODS_BREAKER_COOLDOWN has passed the next request probes iRODS and
+// closes the breaker if it answers.
+const (
+	irodsRetryAttempts    = 4
+	irodsRetryBaseDelay   = 100 * time.Millisecond
+	irodsRetryMaxDelay    = 2 * time.Second
+	irodsOpTimeout        = 30 * time.Second
+	irodsScanTimeout      = 10 * time.Minute
+	irodsBreakerThreshold = 5
+	irodsBreakerCooldown  = 10 * time.Second
+
+	// How long the result of a probe is trusted
+	irodsProbeInterval = time.Second
+)
+
+// irodsBreaker tracks consecutive failures to reach iRODS. A breaker with a
+// threshold of 0 never opens.
+type irodsBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	probe     func() error
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	// Serializes probes, their result is shared for irodsProbeInterval
+	probeMu  sync.Mutex
+	probedAt time.Time
+	probeErr error
+}
+
+func newIrodsBreaker(threshold int, cooldown time.Duration, probe func() error) *irodsBreaker {
+	return &irodsBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		probe:     probe,
+	}
+}
+
+// allow returns minio.BackendDown while the breaker is open. The first call
+// after the cooldown probes iRODS, the others fail until it is done.
+func (b *irodsBreaker) allow() error {
+	b.mu.Lock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		b.mu.Unlock()
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		b.mu.Unlock()
+		return minio.BackendDown{}
+	}
+	b.probing = true
+	b.mu.Unlock()
+
+	err := b.probe()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return minio.BackendDown{}
+	}
+	b.failures = 0
+	logger.Info("iRODS is reachable again")
+	return nil
+}
+
+// Records an operation that reached iRODS.
+func (b *irodsBreaker) succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+}
+
+// Records an operation that failed to reach iRODS, opening the breaker once
+// threshold operations in a row failed.
+func (b *irodsBreaker) fail() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.threshold > 0 && b.failures == b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		logger.Info("iRODS is unreachable, failing requests for %v", b.cooldown)
+	}
+}
+
+// isDown returns true if iRODS can't be reached, probing it at most once
+// per irodsProbeInterval.
+func (b *irodsBreaker) isDown() bool {
+	b.probeMu.Lock()
+	defer b.probeMu.Unlock()
+
+	if time.Since(b.probedAt) >= irodsProbeInterval {
+		b.probeErr = b.probe()
+		b.probedAt = time.Now()
+	}
+	return b.probeErr != nil
+}
+
+// probeIrods reads the mount collection over a new connection, the pooled
+// ones may be stuck on the request that failed.
+func (a *irodsObjects) probeIrods() error {
+	rodsCon, err := gorods.NewConnection(a.conOpts)
+	if err != nil {
+		return err
+	}
+	defer rodsCon.Disconnect()
+
+	_, err = rodsCon.Collection(gorods.CollectionOptions{
+		Path: a.colPath,
+	})
+	return err
+}
+
+// Returns the delay before retry attempt, drawn at random up to an
+// exponentially growing bound, so gateways don't retry in step.
+func getIrodsBackoff(attempt int) time.Duration {
+	bound := irodsRetryBaseDelay << uint(attempt)
+	if bound <= 0 || bound > irodsRetryMaxDelay {
+		bound = irodsRetryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(bound))) + 1
+}
+
+// errIrodsOpTimeout is returned for a call abandoned at its deadline.
+var errIrodsOpTimeout = errors.New("iRODS operation timed out")
+
+// Errors iRODS answers with, which tell it is reachable without a probe.
+var irodsAnswerErrors = []string{
+	"does not exist",
+	"not found",
+	"cat_no_rows_found",
+	"cat_unknown_",
+	"cat_no_access_permission",
+	"cat_name_exists_as_",
+	"user_file_does_not_exist",
+	"obj_path_does_not_exist",
+	"overwrite_without_force_flag",
+}
+
+// isIrodsAnswer returns true if err was answered by iRODS rather than caused
+// by failing to reach it.
+func isIrodsAnswer(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, answer := range irodsAnswerErrors {
+		if strings.Contains(msg, answer) {
+			return true
+		}
+	}
+	return false
+}
+
+// irodsOpResult is what an op run by runIrodsOp returned.
+type irodsOpResult struct {
+	val interface{}
+	err error
+}
+
+// runIrodsOp runs op, giving up on it after timeout unless timeout is 0. An
+// abandoned op keeps running until GoRODS returns, its result is dropped.
+func (a *irodsObjects) runIrodsOp(op func() (interface{}, error), timeout time.Duration) (interface{}, error) {
+	if timeout <= 0 {
+		return op()
+	}
+
+	done := make(chan irodsOpResult, 1)
+	go func() {
+		val, err := op()
+		done <- irodsOpResult{val, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.val, res.err
+	case <-timer.C:
+		return nil, errIrodsOpTimeout
+	}
+}
+
+// retryIrods runs op within opTimeout, see retryIrodsTimeout.
+func (a *irodsObjects) retryIrods(op func() (interface{}, error)) (interface{}, error) {
+	return a.retryIrodsTimeout(op, a.opTimeout)
+}
+
+// retryIrodsTimeout runs op, which must be safe to repeat, until it succeeds,
+// fails for a reason other than iRODS being unreachable, or has used up its
+// attempts or timeout. An op that fails while iRODS answers a probe may have
+// run on a connection cut off by an outage, it is tried once more on a new
+// one. Returns minio.BackendDown if iRODS couldn't be reached and
+// minio.OperationTimedOut if it answers but op took longer than timeout.
+func (a *irodsObjects) retryIrodsTimeout(op func() (interface{}, error), timeout time.Duration) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	renewed := false
+
+	for attempt := 0; ; attempt++ {
+		if err := a.breaker.allow(); err != nil {
+			return nil, err
+		}
+
+		var left time.Duration
+		if timeout > 0 {
+			if left = time.Until(deadline); left <= 0 {
+				return nil, minio.BackendDown{}
+			}
+		}
+		val, err := a.runIrodsOp(op, left)
+		if err == nil || isIrodsAnswer(err) {
+			a.breaker.succeed()
+			return val, err
+		}
+		if err == errIrodsOpTimeout {
+			go a.replenishPool()
+		}
+
+		if !a.breaker.isDown() {
+			a.breaker.succeed()
+			if err == errIrodsOpTimeout {
+				return nil, minio.OperationTimedOut{}
+			}
+			a.expirePool()
+			if renewed {
+				return nil, err
+			}
+			renewed = true
+			continue
+		}
+		a.expirePool()
+		a.breaker.fail()
+
+		delay := getIrodsBackoff(attempt)
+		if err == errIrodsOpTimeout || attempt+1 >= a.retryAttempts || (timeout > 0 && time.Now().Add(delay).After(deadline)) {
+			return nil, minio.BackendDown{}
+		}
+		select {
+		case <-a.done:
+			return nil, minio.BackendDown{}
+		case <-time.After(delay):
+		}
+	}
+}
+
+// openCol connects to iRODS for the connection pool.
+func (a *irodsObjects) openCol() (*gorods.Collection, error) {
+	rodsCon, err := gorods.NewConnection(a.conOpts)
+	if err != nil {
+		return nil, err
+	}
+	col, err := rodsCon.Collection(gorods.CollectionOptions{
+		Path: a.colPath,
+	})
+	if err != nil {
+		rodsCon.Disconnect()
+		return nil, err
+	}
+
+	a.poolMu.Lock()
+	defer a.poolMu.Unlock()
+	a.colOpened[col] = time.Now()
+	return col, nil
+}
+
+// replenishPool adds a new connection to the pool in place of one held by an
+// abandoned op. ReturnCol drops the connection the op returns if the pool is
+// full by then.
+func (a *irodsObjects) replenishPool() {
+	col, err := a.openCol()
+	if err != nil {
+		return
+	}
+	a.ReturnCol(col)
+}
+
+// closeCol disconnects a connection which is not going back to the pool.
+func (a *irodsObjects) closeCol(col *gorods.Collection) {
+	a.poolMu.Lock()
+	delete(a.colOpened, col)
+	a.poolMu.Unlock()
+	col.Con().Disconnect()
+}
+
+// expirePool has every pooled connection opened so far replaced before it is
+// used again.
+func (a *irodsObjects) expirePool() {
+	a.poolMu.Lock()
+	defer a.poolMu.Unlock()
+
+	a.staleBefore = time.Now()
+}
+
+// renewCol returns a new connection in place of col if col was opened before
+// iRODS last failed to answer. col is kept if iRODS can't be reached yet.
+func (a *irodsObjects) renewCol(col *gorods.Collection) *gorods.Collection {
+	a.poolMu.Lock()
+	stale := a.colOpened[col].Before(a.staleBefore)
+	a.poolMu.Unlock()
+	if !stale {
+		return col
+	}
+
+	renewed, err := a.openCol()
+	if err != nil {
+		return col
+	}
+
+	a.closeCol(col)
+	return renewed
+}
+
+// isIrodsBackendDown returns true if err reports iRODS as unreachable.
+func isIrodsBackendDown(err error) bool {
+	_, ok := err.(minio.BackendDown)
+	return ok
+}
+
+// irodsBackendError returns cause if it reports iRODS as unreachable, so
+// clients are told to back off, and err otherwise.
+func irodsBackendError(cause, err error) error {
+	if isIrodsBackendDown(cause) {
+		return cause
+	}
+	return err
+}
+
+// irodsRetryCatalog retries the queries of catalog.
+type irodsRetryCatalog struct {
+	a       *irodsObjects
+	catalog irodsCatalog
+}
+
+// Prefix queries return every key below the prefix, they are given
+// scanTimeout.
+func (c irodsRetryCatalog) queryMetaPrefix(attr, units, prefix string) ([][]string, error) {
+	val, err := c.a.retryIrodsTimeout(func() (interface{}, error) {
+		return c.catalog.queryMetaPrefix(attr, units, prefix)
+	}, c.a.scanTimeout)
+	rows, _ := val.([][]string)
+	return rows, err
+}
+
+func (c irodsRetryCatalog) queryMetaValue(attr, units, value string) ([][]string, error) {
+	val, err := c.a.retryIrods(func() (interface{}, error) {
+		return c.catalog.queryMetaValue(attr, units, value)
+	})
+	rows, _ := val.([][]string)
+	return rows, err
+}
@@ -0,0 +1,123 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIrodsBreaker(t *testing.T) {
+	type breakerStep struct {
+		op      string // fail, succeed or allow
+		probeUp bool
+		allowed bool
+		probed  bool
+	}
+	testCases := []struct {
+		threshold int
+		cooldown  time.Duration
+		steps     []breakerStep
+	}{
+		// Opens after threshold failures in a row
+		{2, time.Hour, []breakerStep{
+			{op: "fail"},
+			{op: "allow", allowed: true},
+			{op: "fail"},
+			{op: "allow", probeUp: true, allowed: false},
+		}},
+		// A success resets the count
+		{2, time.Hour, []breakerStep{
+			{op: "fail"},
+			{op: "succeed"},
+			{op: "fail"},
+			{op: "allow", allowed: true},
+		}},
+		// After the cooldown a probe closes it if iRODS answers
+		{1, 0, []breakerStep{
+			{op: "fail"},
+			{op: "allow", probeUp: false, allowed: false, probed: true},
+			{op: "allow", probeUp: true, allowed: true, probed: true},
+			{op: "allow", allowed: true},
+		}},
+		// A threshold of 0 never opens
+		{0, time.Hour, []breakerStep{
+			{op: "fail"},
+			{op: "fail"},
+			{op: "allow", allowed: true},
+		}},
+	}
+
+	for i, testCase := range testCases {
+		var probeUp, probed bool
+		b := newIrodsBreaker(testCase.threshold, testCase.cooldown, func() error {
+			probed = true
+			if probeUp {
+				return nil
+			}
+			return errors.New("connection refused")
+		})
+		for j, step := range testCase.steps {
+			switch step.op {
+			case "fail":
+				b.fail()
+			case "succeed":
+				b.succeed()
+			case "allow":
+				probeUp, probed = step.probeUp, false
+				if err := b.allow(); (err == nil) != step.allowed {
+					t.Errorf("Test %d, step %d: allow() returned %v, expected allowed %v", i+1, j+1, err, step.allowed)
+				}
+				if probed != step.probed {
+					t.Errorf("Test %d, step %d: allow() probed %v, expected %v", i+1, j+1, probed, step.probed)
+				}
+			}
+		}
+	}
+}
+
+func TestGetIrodsBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		bound   time.Duration
+	}{
+		{0, irodsRetryBaseDelay},
+		{1, 2 * irodsRetryBaseDelay},
+		{3, 8 * irodsRetryBaseDelay},
+		{10, irodsRetryMaxDelay},
+		// Shifts past the width of a Duration are capped too
+		{100, irodsRetryMaxDelay},
+	}
+
+	for i, testCase := range testCases {
+		for n := 0; n < 100; n++ {
+			if delay := getIrodsBackoff(testCase.attempt); delay <= 0 || delay > testCase.bound {
+				t.Errorf("Test %d: getIrodsBackoff(%d) = %v, expected a delay in (0, %v]", i+1, testCase.attempt, delay, testCase.bound)
+				break
+			}
+		}
+	}
+}
+
+func TestIsIrodsAnswer(t *testing.T) {
+	testCases := []struct {
+		err    error
+		answer bool
+	}{
+		{errors.New("CAT_NO_ROWS_FOUND"), true},
+		{errors.New("rcObjStat failed: USER_FILE_DOES_NOT_EXIST"), true},
+		{errors.New("Collection does not exist"), true},
+		{errors.New("connection refused"), false},
+		{errors.New("i/o timeout"), false},
+		{errIrodsOpTimeout, false},
+	}
+
+	for i, testCase := range testCases {
+		if answer := isIrodsAnswer(testCase.err); answer != testCase.answer {
+			t.Errorf("Test %d: isIrodsAnswer(%v) = %v, expected %v", i+1, testCase.err, answer, testCase.answer)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/minio/cmd/logger"
+
+	minio "github.com/minio/minio/cmd"
+)
+
+const (
+	irodsScrubTimeMetaAttr   = "minio_scrub_time"
+	irodsScrubResultMetaAttr = "minio_scrub_result"
+	irodsScrubResultOK       = "ok"
+	irodsScrubResultCorrupt  = "corrupt"
+	irodsScrubLeaseMetaAttr  = "minio_scrub_lease"
+	irodsScrubRate           = 10
+	irodsScrubIchksum        = "ichksum"
+)
+
+// irodsObjectCorrupt is logged for objects the scrubber found corrupt.
+type irodsObjectCorrupt struct {
+	Bucket string
+	Object string
+}
+
+func (e irodsObjectCorrupt) Error() string {
+	return fmt.Sprintf("Object %v/%v failed checksum verification", e.Bucket, e.Object)
+}
+
+// irodsScrubStats counts what a scrubber pass verified in one bucket.
+type irodsScrubStats struct {
+	Objects int
+	Corrupt int
+	Bytes   int64
+}
+
+// runScrubber verifies the stored data of every object against its catalog
+// checksum each scrubInterval until the gateway shuts down.
+func (a *irodsObjects) runScrubber() {
+	if a.scrubInterval <= 0 {
+		return
+	}
+
+	// iRODS verifies the replicas itself if the icommand is installed
+	if a.scrubIchksum != "" {
+		if ichksum, err := exec.LookPath(a.scrubIchksum); err == nil {
+			a.scrubIchksum = ichksum
+		} else {
+			logger.Info("%v not found, the iRODS scrubber reads data back through the gateway", a.scrubIchksum)
+			a.scrubIchksum = ""
+		}
+	}
+
+	ticker := time.NewTicker(a.scrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.scrubOnce(context.Background())
+		}
+	}
+}
+
+func (a *irodsObjects) scrubOnce(ctx context.Context) {
+	buckets, err := a.ListBuckets(ctx)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return
+	}
+
+	// Limit the read load the scrubber puts on the storage resources
+	throttle := time.NewTicker(time.Second / time.Duration(a.scrubRate))
+	defer throttle.Stop()
+
+	for _, bucket := range buckets {
+		// Only one gateway instance scrubs a bucket at a time
+		if !a.acquireBucketLease(ctx, bucket.Name, irodsScrubLeaseMetaAttr, 2*a.scrubInterval) {
+			continue
+		}
+
+		stats, sErr := a.scrubBucket(ctx, bucket.Name, throttle.C)
+		if sErr != nil {
+			logger.LogIf(ctx, fmt.Errorf("iRODS scrubber failed on bucket %v: %v", bucket.Name, sErr))
+		}
+		if stats.Objects > 0 {
+			logger.Info("iRODS scrubber verified %d objects (%d bytes) in %v, %d corrupt",
+				stats.Objects, stats.Bytes, bucket.Name, stats.Corrupt)
+		}
+	}
+}
+
+func (a *irodsObjects) scrubBucket(ctx context.Context, bucket string, throttle <-chan time.Time) (stats irodsScrubStats, err error) {
+	objs, err := a.queryObjects(bucket, "")
+	if err != nil {
+		return stats, err
+	}
+
+	for _, blob := range dedupeIrodsObjectRows(objs) {
+		select {
+		case <-a.done:
+			return stats, nil
+		case <-throttle:
+		}
+
+		blobName := blob[0]
+		rodsObj, oErr := a.getDataObjInBucket(bucket, blob[4])
+		if oErr != nil {
+			continue
+		}
+
+		ok, vErr := a.verifyRodsObjData(ctx, rodsObj, blob[3])
+		if vErr != nil {
+			// Read errors may be transient, the object is checked again next pass
+			logger.LogIf(ctx, fmt.Errorf("iRODS scrubber unable to verify %v/%v: %v", bucket, blobName, vErr))
+			continue
+		}
+
+		result := irodsScrubResultOK
+		if !ok {
+			result = irodsScrubResultCorrupt
+			stats.Corrupt++
+			logger.LogIf(ctx, irodsObjectCorrupt{Bucket: bucket, Object: blobName})
+		}
+		logger.LogIf(ctx, setRodsObjScrubResult(rodsObj, result, time.Now()))
+
+		size, _ := strconv.ParseInt(blob[2], 10, 64)
+		stats.Objects++
+		stats.Bytes += size
+	}
+
+	return stats, nil
+}
+
+// verifyRodsObjData has iRODS verify every replica of a data object against
+// the checksum in the catalog. Objects without a catalog checksum are
+// checksummed instead, there is nothing to compare them with yet.
+func (a *irodsObjects) verifyRodsObjData(ctx context.Context, obj *gorods.DataObj, chkSum string) (bool, error) {
+	if chkSum == "" {
+		_, err := obj.Chksum()
+		return err == nil, err
+	}
+	if a.scrubIchksum != "" {
+		return a.verifyRodsObjReplicas(ctx, obj.Path())
+	}
+	return readRodsObjData(obj, chkSum)
+}
+
+// verifyRodsObjReplicas runs "ichksum -K -a", GoRODS doesn't expose
+// rcDataObjChksum with VERIFY_CHKSUM_KW and CHKSUM_ALL_KW.
+func (a *irodsObjects) verifyRodsObjReplicas(ctx context.Context, path string) (bool, error) {
+	out, err := a.irodsICommand(ctx, a.scrubIchksum, "-K", "-a", path).CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(string(out), "USER_CHKSUM_MISMATCH") {
+		return false, nil
+	}
+	return false, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+}
+
+// readRodsObjData reads the replica iRODS serves to the gateway back and
+// compares its content with the checksum in the catalog.
+func readRodsObjData(obj *gorods.DataObj, chkSum string) (bool, error) {
+	want, err := parseIrodsChecksum(chkSum)
+	if err != nil {
+		return false, err
+	}
+
+	var h hash.Hash
+	if want.Algorithm == irodsChecksumSHA256 {
+		h = sha256.New()
+	} else {
+		h = md5.New()
+	}
+
+	if _, err = io.Copy(h, obj.Reader()); err != nil {
+		obj.Close()
+		return false, err
+	}
+	if err = obj.Close(); err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(h.Sum(nil), want.Sum), nil
+}
+
+// Replaces the scrub AVUs of obj with the result of the latest verification.
+func setRodsObjScrubResult(obj *gorods.DataObj, result string, now time.Time) error {
+	obj.DeleteMeta(irodsScrubTimeMetaAttr)
+	obj.DeleteMeta(irodsScrubResultMetaAttr)
+
+	if _, err := obj.AddMeta(gorods.Meta{
+		irodsScrubTimeMetaAttr, strconv.FormatInt(now.Unix(), 10), "", nil,
+	}); err != nil {
+		return err
+	}
+	_, err := obj.AddMeta(gorods.Meta{
+		irodsScrubResultMetaAttr, result, "", nil,
+	})
+	return err
+}
+
+// checkRodsObjScrubResult returns minio.PrefixAccessDenied, which clients see
+// as AccessDenied, if the scrubber marked obj corrupt and the gateway is
+// configured to refuse serving such objects. The corruption is logged.
+func (a *irodsObjects) checkRodsObjScrubResult(ctx context.Context, bucket, object string, obj *gorods.DataObj) error {
+	if !a.scrubRefuseCorrupt {
+		return nil
+	}
+
+	metas, err := obj.Attribute(irodsScrubResultMetaAttr)
+	if err != nil {
+		return nil
+	}
+	for _, m := range metas {
+		if m.Value == irodsScrubResultCorrupt {
+			logger.LogIf(ctx, irodsObjectCorrupt{Bucket: bucket, Object: object})
+			return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+		}
+	}
+	return nil
+}
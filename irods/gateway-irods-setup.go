@@ -0,0 +1,223 @@
+/*
+ * BioTeam (C) 2018 The BioTeam, Inc.
+ */
+
+package irods
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	gorods "github.com/jjacquay712/GoRODS"
+	"github.com/minio/cli"
+	"github.com/minio/minio/cmd/logger"
+)
+
+// Builtin specific query returning the alias and SQL of an installed query.
+const irodsFindQueryByAlias = "findQueryByAlias"
+
+// irodsSpecificQuery is a specific query the gateway can use, and what it is
+// used for.
+type irodsSpecificQuery struct {
+	Alias   string
+	SQL     string
+	Feature string
+}
+
+// The specific queries installed by 'minio gateway irods setup'. The SQL is
+// the one documented next to each alias.
+var irodsSetupQueries = []irodsSpecificQuery{
+	{irodsListQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' ORDER BY R_META_MAIN.meta_attr_value ASC`,
+		"listing objects and uploads"},
+	{irodsStatQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value = ? ORDER BY R_META_MAIN.meta_attr_value ASC`,
+		"looking up objects and upload parts"},
+	{irodsListKeysQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' ORDER BY R_META_MAIN.meta_attr_value ASC`,
+		"the minio_key index"},
+	{irodsStatKeyQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value = ? ORDER BY R_META_MAIN.meta_attr_value ASC`,
+		"the minio_key index"},
+	{irodsListPrefixesQuery, `SELECT DISTINCT SUBSTR(R_META_MAIN.meta_attr_value, 1, CHAR_LENGTH(?) + STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) + CHAR_LENGTH(?) - 1) COLLATE "C" AS prefix FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' AND R_META_MAIN.meta_attr_value COLLATE "C" > ? AND STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) > 0 ORDER BY prefix ASC LIMIT ?`,
+		"common prefixes computed by the catalog"},
+	{irodsListChildrenQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' AND R_META_MAIN.meta_attr_value COLLATE "C" > ? AND STRPOS(SUBSTR(R_META_MAIN.meta_attr_value, CHAR_LENGTH(?) + 1), ?) = 0 ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?`,
+		"common prefixes computed by the catalog"},
+	{irodsListKeysPageQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_unit = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' AND R_META_MAIN.meta_attr_value COLLATE "C" > ? ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?`,
+		"paged listings"},
+	{irodsListObjectsPageQuery, `SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value LIKE ? ESCAPE '\' AND R_META_MAIN.meta_attr_value COLLATE "C" > ? ORDER BY R_META_MAIN.meta_attr_value COLLATE "C" ASC LIMIT ?`,
+		"paged listings"},
+}
+
+// Status of an installed specific query compared to the expected one.
+const (
+	irodsQueryOK       = "ok"
+	irodsQueryMissing  = "missing"
+	irodsQueryOutdated = "outdated"
+	irodsQueryUnknown  = "unknown"
+)
+
+// Compares SQL regardless of whitespace.
+func normalizeIrodsSQL(sql string) string {
+	return strings.Join(strings.Fields(sql), " ")
+}
+
+// checkSpecificQuery returns the status of the specific query q in the zone.
+func (a *irodsObjects) checkSpecificQuery(q irodsSpecificQuery) string {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	rows, err := col.Con().IQuestSQL(irodsFindQueryByAlias, q.Alias)
+	if err != nil {
+		return irodsQueryUnknown
+	}
+	if len(rows) == 0 || len(rows[0]) < 2 {
+		return irodsQueryMissing
+	}
+	if normalizeIrodsSQL(rows[0][1]) != normalizeIrodsSQL(q.SQL) {
+		return irodsQueryOutdated
+	}
+	return irodsQueryOK
+}
+
+// checkSpecificQueries logs every specific query which is missing or doesn't
+// match the SQL this gateway expects, with what doesn't work without it.
+func (a *irodsObjects) checkSpecificQueries() {
+	for _, q := range irodsSetupQueries {
+		switch status := a.checkSpecificQuery(q); status {
+		case irodsQueryUnknown:
+			logger.Info("Unable to check the specific queries with %v", irodsFindQueryByAlias)
+			return
+		case irodsQueryMissing, irodsQueryOutdated:
+			logger.Info("Specific query %v is %v, %v falls back to slower lookups. Run \"minio gateway irods setup\" to install it", q.Alias, status, q.Feature)
+		}
+	}
+}
+
+// Returns the iadmin invocations installing q, removing an outdated version first.
+func irodsSetupCommands(q irodsSpecificQuery, status string) [][]string {
+	var cmds [][]string
+	if status == irodsQueryOutdated {
+		cmds = append(cmds, []string{"iadmin", "rsq", q.Alias})
+	}
+	return append(cmds, []string{"iadmin", "asq", q.SQL, q.Alias})
+}
+
+// Quotes args for printing as a shell command.
+func irodsShellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " '\\?") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// irodsICommand returns an icommand run against the gateway's zone as the
+// gateway's user. The icommands authenticate with the iRODS environment of
+// the account the gateway runs as, which has to be set up with iinit.
+func (a *irodsObjects) irodsICommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(),
+		"IRODS_HOST="+a.conOpts.Host,
+		"IRODS_PORT="+strconv.Itoa(a.conOpts.Port),
+		"IRODS_ZONE_NAME="+a.conOpts.Zone,
+		"IRODS_USER_NAME="+a.conOpts.Username,
+	)
+	return cmd
+}
+
+// Handler for 'minio gateway irods setup' command line.
+func irodsSetupMain(ctx *cli.Context) {
+	a := newIrodsCommandLayer(ctx)
+	defer a.Shutdown(context.Background())
+
+	printOnly := ctx.Bool("print")
+	if _, err := exec.LookPath("iadmin"); err != nil && !printOnly {
+		fmt.Println("iadmin not found, printing the commands to run as rodsadmin instead")
+		printOnly = true
+	}
+
+	failed := false
+
+	fmt.Println("Specific queries:")
+	for _, q := range irodsSetupQueries {
+		status := a.checkSpecificQuery(q)
+		fmt.Printf("  %-28v %v\n", q.Alias, status)
+		if status == irodsQueryOK {
+			continue
+		}
+
+		if printOnly {
+			for _, args := range irodsSetupCommands(q, status) {
+				fmt.Printf("    %v\n", irodsShellCommand(args))
+			}
+			continue
+		}
+		if err := runIrodsSetupCommands(irodsSetupCommands(q, status)); err != nil {
+			fmt.Printf("    %v\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  %-28v installed\n", q.Alias)
+	}
+
+	fmt.Println("Mount collection:")
+	if err := a.checkMountCollection(); err != nil {
+		fmt.Printf("  %v\n", err)
+		failed = true
+	} else {
+		fmt.Println("  ok")
+	}
+
+	if failed {
+		a.Shutdown(context.Background())
+		os.Exit(1)
+	}
+}
+
+// Runs the iadmin invocations returned by irodsSetupCommands.
+func runIrodsSetupCommands(cmds [][]string) error {
+	for _, args := range cmds {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v failed: %v", strings.Join(args[:2], " "), err)
+		}
+	}
+	return nil
+}
+
+// checkMountCollection verifies the gateway user can write to the mount
+// collection, which it needs to create buckets. Write access granted through
+// a group doesn't show up as the user's own permission, the user then tries
+// to create a collection instead.
+func (a *irodsObjects) checkMountCollection() error {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	acls, err := col.ACL()
+	if err != nil {
+		return fmt.Errorf("unable to read the permissions of %v: %v", col.Path(), err)
+	}
+	for _, acl := range acls {
+		if acl.AccessObject.Name() == a.user && acl.AccessLevel >= gorods.Write {
+			return nil
+		}
+	}
+
+	probeID, err := getIrodsUploadID()
+	if err != nil {
+		return err
+	}
+	probe, err := col.CreateSubCollection(".minio_setup_" + probeID)
+	if err != nil {
+		return fmt.Errorf("%v can't write to %v, run \"ichmod write %v %v\"", a.user, col.Path(), a.user, col.Path())
+	}
+	if err = probe.Destroy(); err != nil {
+		return fmt.Errorf("unable to remove %v: %v", probe.Path(), err)
+	}
+	return nil
+}
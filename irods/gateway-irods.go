@@ -8,16 +8,19 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
@@ -28,6 +31,7 @@ import (
 	"github.com/minio/minio/pkg/auth"
 	"github.com/minio/minio/pkg/policy"
 	"github.com/minio/minio/pkg/policy/condition"
+	"github.com/prometheus/client_golang/prometheus"
 
 	minio "github.com/minio/minio/cmd"
 )
@@ -35,15 +39,23 @@ import (
 const (
 	irodsBlockSize             = 100 * humanize.MiByte
 	irodsS3MinPartSize         = 5 * humanize.MiByte
+	irodsS3MaxPartID           = 10000
 	metadataObjectNameTemplate = "multipart_v1_%s_%x_irods.json"
+	tmpObjectNameTemplate      = "tmp_v1_%s_irods"
+	irodsAsideSuffix           = "_old"
 	irodsBackend               = "irods"
 	irodsMarkerPrefix          = "{minio}"
 	irodsIQuestQuery           = "minio_list_objects"
 	irodsMultipartSubCol       = "multiparts"
 	irodsObjMetaAttr           = "minio_obj"
 	irodsMultipartMetaAttr     = "minio_multipart"
+	irodsUploadMetaAttr        = "minio_upload"
+	irodsETagMetaAttr          = "minio_etag"
+	irodsMetaAttrPrefix        = "minio_meta_"
 	irodsBucketMetaAttr        = "minio_loc"
 	irodsConPoolSize           = 4
+	irodsLifecycleInterval     = time.Hour
+	irodsLifecycleRate         = 10
 )
 
 func init() {
@@ -81,6 +93,46 @@ ENVIRONMENT VARIABLES:
      MINIO_CACHE_EXCLUDE: List of cache exclusion patterns delimited by ";".
      MINIO_CACHE_EXPIRY: Cache expiry duration in days.
 
+  LIFECYCLE:
+     MINIO_IRODS_LIFECYCLE_INTERVAL: How often bucket lifecycle rules are evaluated, e.g. "1h". Set to "0" to disable.
+     MINIO_IRODS_LIFECYCLE_RATE: Maximum number of objects expired, transitioned or aborted per second.
+     MINIO_IRODS_STORAGE_CLASSES: Storage class to iRODS resource mapping delimited by ";", e.g. "GLACIER=tapeResc".
+
+  JANITOR:
+     MINIO_IRODS_JANITOR_INTERVAL: How often abandoned multipart uploads and partial objects are removed, e.g. "6h". Set to "0" to disable.
+     MINIO_IRODS_JANITOR_MAX_AGE: Age after which unfinished multipart uploads and writes are considered abandoned, e.g. "168h".
+
+  SCRUBBER:
+     MINIO_IRODS_SCRUB_INTERVAL: How often the data of every object is verified against its iRODS checksum, e.g. "168h". Disabled by default.
+     MINIO_IRODS_SCRUB_RATE: Maximum number of objects verified per second.
+     MINIO_IRODS_SCRUB_REFUSE_CORRUPT: Set to "on" to refuse downloads of objects which failed verification.
+     MINIO_IRODS_SCRUB_ICHKSUM: Path of the ichksum icommand, which verifies every replica inside iRODS. Needs an iRODS environment authenticated as the gateway's user with iinit. Without it the data is read back through the gateway.
+
+  INDEX:
+     MINIO_IRODS_LEGACY_INDEX: Set to "off" to stop looking up objects by minio_obj AVUs once "{{.HelpName}} migrate-index" has run.
+     MINIO_IRODS_OBJECT_NAMING: Hash of the object key new data objects are named after, "sha256" (default) or "md5". Objects named with either are read.
+     MINIO_IRODS_MAX_AVU_VALUE: Size of the catalog's meta_attr_value column in bytes, longer keys are split across several AVUs. Defaults to 2700.
+     MINIO_IRODS_PREFIX_INDEX: Set to "on" to mirror '/' separated folders as collections, so browsing a folder only reads its direct children. Run "{{.HelpName}} build-prefix-index" once to index existing objects. Ignored unless objects are indexed by minio_key AVUs.
+     MINIO_IRODS_GENQUERY: Set to "on" to look up objects with GenQuery even if the specific queries are installed. Used automatically if they are not.
+     MINIO_IRODS_IQUEST: Path of the iquest icommand, which runs each GenQuery lookup as a single query. Needs an iRODS environment authenticated as the gateway's user with iinit. Without it the AVUs of every matched object are read separately.
+
+  METADATA CACHE:
+     MINIO_IRODS_CACHE_TTL: How long object and bucket lookups are cached, e.g. "10s". Changes made outside the gateway show up after this long. Set to "0" to disable.
+     MINIO_IRODS_CACHE_SIZE: Maximum number of cached objects and buckets.
+     MINIO_IRODS_CACHE_STATS_INTERVAL: How often cache hits and misses are logged, e.g. "1h". Disabled by default, they are always exported as minio_irods_cache_* Prometheus metrics.
+
+  OBJECT LOCK:
+     MINIO_IRODS_LOCK_USER: iRODS account owning objects under retention or legal hold, all other users including the gateway's are reduced to read. Without one, locked objects stay read only after their lock expires.
+     MINIO_IRODS_LOCK_PASSWORD: Password of MINIO_IRODS_LOCK_USER.
+     MINIO_IRODS_ISYSMETA: Path of the isysmeta icommand, which sets the expiry of locked data objects to their retain until date. Needs an iRODS environment authenticated as the gateway's user with iinit. Without it the date is only kept in AVUs.
+
+  RETRIES:
+     MINIO_IRODS_RETRY_ATTEMPTS: Number of times lookups, listings and reads are tried while iRODS is unreachable. Defaults to 4.
+     MINIO_IRODS_OP_TIMEOUT: How long one of them is retried for, e.g. "30s". A call iRODS doesn't answer within this long is given up on. Set to "0" for no limit.
+     MINIO_IRODS_SCAN_TIMEOUT: Same for catalog queries reading every key below a prefix, e.g. "10m". Set to "0" for no limit. Subcommands never time out.
+     MINIO_IRODS_BREAKER_THRESHOLD: Number of failures in a row after which requests fail at once with "backend down". Defaults to 5, set to "0" to never fail at once.
+     MINIO_IRODS_BREAKER_COOLDOWN: How long requests fail at once before iRODS is tried again, e.g. "10s".
+
 EXAMPLES:
   1. Start minio gateway server for iRODS Storage backend.
      $ export MINIO_ACCESS_KEY=accountname
@@ -98,6 +150,11 @@ EXAMPLES:
      $ export MINIO_CACHE_EXCLUDE="bucket1/*;*.png"
      $ export MINIO_CACHE_EXPIRY=40
      $ {{.HelpName}}
+
+  4. Rewrite the object index created by older gateway versions.
+     $ export MINIO_ACCESS_KEY=accountname
+     $ export MINIO_SECRET_KEY=accountkey
+     $ {{.HelpName}} migrate-index irods.example.com 1247 tempZone /tempZone/home/accountname
 `
 
 	minio.RegisterGatewayCommand(cli.Command{
@@ -106,6 +163,32 @@ EXAMPLES:
 		Action:             irodsGatewayMain,
 		CustomHelpTemplate: irodsGatewayTemplate,
 		HideHelpCommand:    true,
+		Subcommands: []cli.Command{
+			{
+				Name:      "migrate-index",
+				Usage:     "Rewrite legacy minio_obj AVUs as minio_key AVUs.",
+				ArgsUsage: "[HOST] [PORT] [ZONE] [COL]",
+				Action:    irodsMigrateIndexMain,
+			},
+			{
+				Name:      "build-prefix-index",
+				Usage:     "Add existing objects to the prefix index.",
+				ArgsUsage: "[HOST] [PORT] [ZONE] [COL]",
+				Action:    irodsBuildPrefixIndexMain,
+			},
+			{
+				Name:      "setup",
+				Usage:     "Install the specific queries and check the mount collection.",
+				ArgsUsage: "[HOST] [PORT] [ZONE] [COL]",
+				Action:    irodsSetupMain,
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "print",
+						Usage: "Print the iadmin commands instead of running them.",
+					},
+				},
+			},
+		},
 	})
 }
 
@@ -115,18 +198,64 @@ func getMD5Hash(text string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// getObjectInBucket returns the data object holding object. A data object
+// whose name matches but which is indexed under a different key is a hash
+// collision and is not returned.
 func (a *irodsObjects) getObjectInBucket(bucket, object string) (*gorods.DataObj, error) {
-	objectNameHash := getMD5Hash(object)
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-	return col.Con().DataObject(col.Path() + "/" + bucket + "/" + objectNameHash)
+	for _, name := range a.getObjectNames(object) {
+		rodsObj, err := a.getDataObjInBucket(bucket, name)
+		if isIrodsBackendDown(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		if key, ok := getRodsObjKey(rodsObj, bucket); ok && key == object {
+			return rodsObj, nil
+		}
+	}
+
+	// A commit in flight renames the previous version aside before the new
+	// one is renamed into place and indexed, it is found by its index AVUs
+	return a.getAsideObjectInBucket(bucket, object)
+}
+
+// getAsideObjectInBucket returns the previous version of object while
+// commitRodsObj has it renamed aside.
+func (a *irodsObjects) getAsideObjectInBucket(bucket, object string) (*gorods.DataObj, error) {
+	rows, err := a.lookupObject(bucket, object)
+	if isIrodsBackendDown(err) {
+		return nil, err
+	}
+	for _, row := range rows {
+		if !strings.HasSuffix(row[4], irodsAsideSuffix) {
+			continue
+		}
+		rodsObj, oErr := a.getDataObjInBucket(bucket, row[4])
+		if isIrodsBackendDown(oErr) {
+			return nil, oErr
+		}
+		if oErr == nil {
+			return rodsObj, nil
+		}
+	}
+	return nil, minio.ObjectNotFound{Bucket: bucket, Object: object}
+}
+
+func (a *irodsObjects) getDataObjInBucket(bucket, name string) (*gorods.DataObj, error) {
+	rodsObj, err := a.retryIrods(func() (interface{}, error) {
+		col := a.GetCol()
+		defer a.ReturnCol(col)
+		return col.Con().DataObject(col.Path() + "/" + bucket + "/" + name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rodsObj.(*gorods.DataObj), nil
 }
 
 func (a *irodsObjects) getMetaObjectInBucket(bucket, uploadID, metaObject string) (*gorods.DataObj, error) {
-	objectName := getIrodsMetadataObjectName(metaObject, uploadID)
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-	return col.Con().DataObject(col.Path() + "/" + bucket + "/" + objectName)
+	return a.getDataObjInBucket(bucket, getIrodsMetadataObjectName(metaObject, uploadID))
 }
 
 // Returns true if marker was returned by iRODS, i.e prefixed with
@@ -137,13 +266,124 @@ func isIrodsMarker(marker string) bool {
 
 // Handler for 'minio gateway irods' command line.
 func irodsGatewayMain(ctx *cli.Context) {
+	minio.StartGateway(ctx, newIrodsFromEnv(ctx))
+}
+
+// Reads the gateway configuration from the [HOST] [PORT] [ZONE] [COL]
+// arguments and the MINIO_IRODS_* environment variables. Shared by the
+// gateway and its subcommands, so both see the same zone the same way.
+func newIrodsFromEnv(ctx *cli.Context) *Irods {
 	// Validate gateway arguments.
 	host := ctx.Args().First()
 	port, _ := strconv.Atoi(ctx.Args().Get(1))
 	zone := ctx.Args().Get(2)
 	colPath := ctx.Args().Get(3)
 
-	minio.StartGateway(ctx, &Irods{host: host, port: port, zone: zone, colPath: colPath})
+	return &Irods{
+		host:    host,
+		port:    port,
+		zone:    zone,
+		colPath: colPath,
+
+		lifecycleInterval: getIrodsEnvDuration("MINIO_IRODS_LIFECYCLE_INTERVAL", irodsLifecycleInterval),
+		lifecycleRate:     getIrodsEnvInt("MINIO_IRODS_LIFECYCLE_RATE", irodsLifecycleRate),
+		storageClasses:    parseIrodsStorageClasses(os.Getenv("MINIO_IRODS_STORAGE_CLASSES")),
+
+		janitorInterval: getIrodsEnvDuration("MINIO_IRODS_JANITOR_INTERVAL", irodsJanitorInterval),
+		janitorMaxAge:   getIrodsEnvDuration("MINIO_IRODS_JANITOR_MAX_AGE", irodsJanitorMaxAge),
+
+		scrubInterval:      getIrodsEnvDuration("MINIO_IRODS_SCRUB_INTERVAL", 0),
+		scrubRate:          getIrodsEnvInt("MINIO_IRODS_SCRUB_RATE", irodsScrubRate),
+		scrubRefuseCorrupt: getIrodsEnvBool("MINIO_IRODS_SCRUB_REFUSE_CORRUPT", false),
+		scrubIchksum:       getIrodsEnv("MINIO_IRODS_SCRUB_ICHKSUM", irodsScrubIchksum),
+
+		legacyIndex: getIrodsEnvBool("MINIO_IRODS_LEGACY_INDEX", true),
+		genQuery:    getIrodsEnvBool("MINIO_IRODS_GENQUERY", false),
+		iquest:      getIrodsEnv("MINIO_IRODS_IQUEST", irodsIQuest),
+		prefixIndex: getIrodsEnvBool("MINIO_IRODS_PREFIX_INDEX", false),
+
+		objectNaming: getIrodsEnvObjectNaming("MINIO_IRODS_OBJECT_NAMING"),
+		maxAVUValue:  getIrodsEnvInt("MINIO_IRODS_MAX_AVU_VALUE", irodsMaxAVUValue),
+
+		cacheTTL:           getIrodsEnvDuration("MINIO_IRODS_CACHE_TTL", irodsCacheTTL),
+		cacheSize:          getIrodsEnvInt("MINIO_IRODS_CACHE_SIZE", irodsCacheSize),
+		cacheStatsInterval: getIrodsEnvDuration("MINIO_IRODS_CACHE_STATS_INTERVAL", 0),
+
+		lockUser:     os.Getenv("MINIO_IRODS_LOCK_USER"),
+		lockPassword: os.Getenv("MINIO_IRODS_LOCK_PASSWORD"),
+		isysmeta:     getIrodsEnv("MINIO_IRODS_ISYSMETA", irodsIsysmeta),
+
+		retryAttempts:    getIrodsEnvInt("MINIO_IRODS_RETRY_ATTEMPTS", irodsRetryAttempts),
+		opTimeout:        getIrodsEnvDuration("MINIO_IRODS_OP_TIMEOUT", irodsOpTimeout),
+		scanTimeout:      getIrodsEnvDuration("MINIO_IRODS_SCAN_TIMEOUT", irodsScanTimeout),
+		breakerThreshold: getIrodsEnvCount("MINIO_IRODS_BREAKER_THRESHOLD", irodsBreakerThreshold),
+		breakerCooldown:  getIrodsEnvDuration("MINIO_IRODS_BREAKER_COOLDOWN", irodsBreakerCooldown),
+	}
+}
+
+// Reads a duration such as "30m" from the environment, falling back to def.
+func getIrodsEnvDuration(name string, def time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		logger.FatalIf(err, "Invalid value for %s", name)
+		return d
+	}
+	return def
+}
+
+// Reads a string from the environment, falling back to def.
+func getIrodsEnv(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Reads a positive integer from the environment, falling back to def.
+func getIrodsEnvInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil && i <= 0 {
+			err = fmt.Errorf("%s must be positive", name)
+		}
+		logger.FatalIf(err, "Invalid value for %s", name)
+		return i
+	}
+	return def
+}
+
+// Reads a non-negative integer from the environment, falling back to def.
+func getIrodsEnvCount(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil && i < 0 {
+			err = fmt.Errorf("%s must not be negative", name)
+		}
+		logger.FatalIf(err, "Invalid value for %s", name)
+		return i
+	}
+	return def
+}
+
+// Reads an "on" or "off" switch from the environment, falling back to def.
+func getIrodsEnvBool(name string, def bool) bool {
+	switch strings.ToLower(os.Getenv(name)) {
+	case "":
+		return def
+	case "off":
+		return false
+	case "on":
+		return true
+	}
+	logger.FatalIf(fmt.Errorf("%s must be on or off", name), "Invalid value for %s", name)
+	return def
+}
+
+// Reads the object naming function from the environment.
+func getIrodsEnvObjectNaming(name string) string {
+	naming, err := parseIrodsObjectNaming(os.Getenv(name))
+	logger.FatalIf(err, "Invalid value for %s", name)
+	return naming
 }
 
 // Irods implements minio.Gateway
@@ -154,6 +394,40 @@ type Irods struct {
 	colPath string
 	user    string
 	pass    string
+
+	lifecycleInterval time.Duration
+	lifecycleRate     int
+	storageClasses    map[string]string
+
+	janitorInterval time.Duration
+	janitorMaxAge   time.Duration
+
+	scrubInterval      time.Duration
+	scrubRate          int
+	scrubRefuseCorrupt bool
+	scrubIchksum       string
+
+	legacyIndex bool
+	genQuery    bool
+	iquest      string
+	prefixIndex bool
+
+	objectNaming string
+	maxAVUValue  int
+
+	cacheTTL           time.Duration
+	cacheSize          int
+	cacheStatsInterval time.Duration
+
+	lockUser     string
+	lockPassword string
+	isysmeta     string
+
+	retryAttempts    int
+	opTimeout        time.Duration
+	scanTimeout      time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 // Name returns the gateway name
@@ -163,35 +437,110 @@ func (g *Irods) Name() string {
 
 // NewGatewayLayer initializes GoRODS client and returns minio.ObjectLayer.
 func (g *Irods) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, error) {
+	a, err := g.newIrodsObjects(creds)
+	if err != nil {
+		return nil, err
+	}
 
-	colPool := make(chan *gorods.Collection, irodsConPoolSize)
-	for i := 0; i < cap(colPool); i++ {
-		rodsCon, conErr := gorods.NewConnection(&gorods.ConnectionOptions{
-			Type: gorods.UserDefined,
+	go a.runLifecycle()
+	go a.runJanitor()
+	go a.runScrubber()
+	go a.runCacheStats()
 
-			Host: g.host,
-			Port: g.port,
-			Zone: g.zone,
+	logger.LogIf(context.Background(), prometheus.Register(irodsCacheCollector{a.cache}))
 
-			Username: creds.AccessKey,
-			Password: creds.SecretKey,
-		})
-		if conErr != nil {
-			return nil, conErr
-		}
+	return a, nil
+}
 
-		col, err := rodsCon.Collection(gorods.CollectionOptions{
-			Path: g.colPath,
-		})
-		if err != nil {
-			return nil, err
+// newIrodsObjects connects to iRODS and detects what the zone supports,
+// without starting the background workers of the gateway.
+func (g *Irods) newIrodsObjects(creds auth.Credentials) (*irodsObjects, error) {
+
+	conOpts := &gorods.ConnectionOptions{
+		Type: gorods.UserDefined,
+
+		Host: g.host,
+		Port: g.port,
+		Zone: g.zone,
+
+		Username: creds.AccessKey,
+		Password: creds.SecretKey,
+	}
+
+	// Identifies this gateway when coordinating background work with others
+	instanceID, err := getIrodsUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &irodsObjects{
+		colPool:    make(chan *gorods.Collection, irodsConPoolSize),
+		colOpened:  make(map[*gorods.Collection]time.Time),
+		conOpts:    conOpts,
+		colPath:    g.colPath,
+		user:       creds.AccessKey,
+		instanceID: instanceID,
+		done:       make(chan struct{}),
+
+		lifecycleInterval: g.lifecycleInterval,
+		lifecycleRate:     g.lifecycleRate,
+		storageClasses:    g.storageClasses,
+
+		janitorInterval: g.janitorInterval,
+		janitorMaxAge:   g.janitorMaxAge,
+
+		scrubInterval:      g.scrubInterval,
+		scrubRate:          g.scrubRate,
+		scrubRefuseCorrupt: g.scrubRefuseCorrupt,
+		scrubIchksum:       g.scrubIchksum,
+
+		legacyIndex: g.legacyIndex,
+		prefixIndex: g.prefixIndex,
+		iquest:      g.iquest,
+
+		objectNaming: g.objectNaming,
+		maxAVUValue:  g.maxAVUValue,
+
+		buckets:            newIrodsBucketRegistry(g.cacheTTL),
+		cache:              newIrodsMetaCache(g.cacheTTL, g.cacheSize),
+		cacheStatsInterval: g.cacheStatsInterval,
+
+		isysmeta: g.isysmeta,
+
+		retryAttempts: g.retryAttempts,
+		opTimeout:     g.opTimeout,
+		scanTimeout:   g.scanTimeout,
+	}
+	for i := 0; i < cap(a.colPool); i++ {
+		col, cErr := a.openCol()
+		if cErr != nil {
+			return nil, cErr
 		}
-		colPool <- col
+		a.colPool <- col
+	}
+	if g.lockUser != "" {
+		lockConOpts := *conOpts
+		lockConOpts.Username = g.lockUser
+		lockConOpts.Password = g.lockPassword
+		a.lockConOpts = &lockConOpts
+	}
+	a.breaker = newIrodsBreaker(g.breakerThreshold, g.breakerCooldown, func() error {
+		_, err := a.runIrodsOp(func() (interface{}, error) {
+			return nil, a.probeIrods()
+		}, a.opTimeout)
+		return err
+	})
+	a.selectCatalog(g.genQuery)
+	a.detectIsysmeta()
+	a.detectKeyIndex()
+	a.detectPrefixIndex()
+	a.detectDelimiterQueries()
+	a.detectPagedQueries()
+	if !a.genQuery {
+		a.checkSpecificQueries()
 	}
 
-	return &irodsObjects{
-		colPool: colPool,
-	}, nil
+	return a, nil
 }
 
 // Production - is iRODS gateway is production ready?
@@ -203,6 +552,85 @@ func (g *Irods) Production() bool {
 type irodsObjects struct {
 	minio.GatewayUnsupported
 	colPool chan *gorods.Collection
+	user    string
+
+	// When the pooled connections were opened, those opened before
+	// staleBefore are replaced when next taken from the pool
+	poolMu      sync.Mutex
+	colOpened   map[*gorods.Collection]time.Time
+	staleBefore time.Time
+
+	// Used to probe iRODS on a connection of its own
+	conOpts *gorods.ConnectionOptions
+	colPath string
+
+	// Connects as the account owning locked objects, nil if there is none
+	lockConOpts *gorods.ConnectionOptions
+
+	// Path of the isysmeta icommand setting the expiry of locked objects
+	isysmeta string
+
+	// Background workers exit once done is closed
+	instanceID string
+	done       chan struct{}
+
+	// Set once the zone turns out to only have irodsIQuestQuery installed
+	legacyQueries int32
+
+	// Answers the metadata queries objects are listed and looked up with,
+	// GenQuery if genQuery is set
+	catalog  irodsCatalog
+	genQuery bool
+
+	// Path of the iquest icommand GenQuery lookups are run with, if any
+	iquest string
+
+	lifecycleInterval time.Duration
+	lifecycleRate     int
+	storageClasses    map[string]string
+
+	janitorInterval time.Duration
+	janitorMaxAge   time.Duration
+
+	scrubInterval      time.Duration
+	scrubRate          int
+	scrubRefuseCorrupt bool
+	scrubIchksum       string
+
+	// Objects are indexed by minio_key AVUs if keyIndex is set, minio_obj
+	// AVUs are looked up as well while legacyIndex is set
+	keyIndex    bool
+	legacyIndex bool
+
+	// Set if the catalog can compute common prefixes
+	delimiterQueries bool
+
+	// Set if listings can be read from the catalog a page at a time
+	pagedQueries bool
+
+	// Folders are mirrored as collections if prefixIndex is set
+	prefixIndex bool
+
+	// Hash function naming the data objects of new objects
+	objectNaming string
+
+	// Longest value the catalog stores in an AVU, in bytes
+	maxAVUValue int
+
+	// Buckets known to exist
+	buckets *irodsBucketRegistry
+
+	// Caches object and bucket lookups, nil if disabled
+	cache              *irodsMetaCache
+	cacheStatsInterval time.Duration
+
+	// Idempotent operations are tried retryAttempts times within opTimeout,
+	// or scanTimeout for listings, while iRODS is unreachable, and fail at
+	// once while the breaker is open
+	retryAttempts int
+	opTimeout     time.Duration
+	scanTimeout   time.Duration
+	breaker       *irodsBreaker
 }
 
 func getMime(objName string) string {
@@ -216,28 +644,23 @@ func irodsToObjectError(err error, params ...string) error {
 }
 
 func (a *irodsObjects) GetCol() *gorods.Collection {
-	return <-a.colPool
+	return a.renewCol(<-a.colPool)
 }
 
+// ReturnCol puts col back into the pool, or disconnects it if the pool has
+// been topped up in its place, see replenishPool.
 func (a *irodsObjects) ReturnCol(col *gorods.Collection) {
-	a.colPool <- col
-}
-
-func (a *irodsObjects) RefreshCols() error {
-	for i := 0; i < cap(a.colPool); i++ {
-		col := a.GetCol()
-		defer a.ReturnCol(col)
-
-		if rErr := col.Refresh(); rErr != nil {
-			return rErr
-		}
+	select {
+	case a.colPool <- col:
+	default:
+		a.closeCol(col)
 	}
-	return nil
 }
 
 // Shutdown - save any gateway metadata to disk
 // if necessary and reload upon next restart.
 func (a *irodsObjects) Shutdown(ctx context.Context) error {
+	close(a.done)
 	return nil
 }
 
@@ -262,6 +685,11 @@ func (a *irodsObjects) MakeBucketWithLocation(ctx context.Context, bucket, locat
 		logger.LogIf(ctx, err)
 		return irodsToObjectError(err, bucket)
 	}
+	a.invalidateBucket(bucket)
+	a.buckets.add(minio.BucketInfo{
+		Name:    bucket,
+		Created: bucketCol.CreateTime(),
+	})
 
 	if location != "" {
 		_, mErr := bucketCol.AddMeta(gorods.Meta{
@@ -270,7 +698,11 @@ func (a *irodsObjects) MakeBucketWithLocation(ctx context.Context, bucket, locat
 		logger.LogIf(ctx, mErr)
 	}
 
-	go a.RefreshCols()
+	if a.prefixIndex {
+		if pErr := a.initPrefixIndex(bucketCol); pErr != nil {
+			return irodsToObjectError(pErr, bucket)
+		}
+	}
 
 	_, err = bucketCol.CreateSubCollection(irodsMultipartSubCol)
 	return irodsToObjectError(err, bucket)
@@ -278,59 +710,96 @@ func (a *irodsObjects) MakeBucketWithLocation(ctx context.Context, bucket, locat
 
 // GetBucketInfo - Get bucket metadata..
 func (a *irodsObjects) GetBucketInfo(ctx context.Context, bucket string) (bi minio.BucketInfo, e error) {
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-
-	searchCol := col.FindCol(bucket)
-	if searchCol != nil {
-		return minio.BucketInfo{
-			Name:    bucket,
-			Created: searchCol.CreateTime(),
-		}, nil
+	if bi, ok := a.getCachedBucketInfo(bucket); ok {
+		return bi, nil
 	}
 
-	logger.LogIf(ctx, minio.BucketNotFound{Bucket: bucket})
-	return bi, minio.BucketNotFound{Bucket: bucket}
+	gen := a.cache.generation()
+	bi, e = a.lookupBucket(bucket)
+	if e != nil {
+		logger.LogIf(ctx, e)
+		return bi, e
+	}
+	a.cacheBucketInfo(bi, gen)
+	return bi, nil
 }
 
 // ListBuckets - Lists all irods containers, uses Irods equivalent ListContainers.
 func (a *irodsObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInfo, err error) {
 	col := a.GetCol()
-	defer a.ReturnCol(col)
-	cols, err := col.Collections()
+	colPath := col.Path()
+	a.ReturnCol(col)
+
+	// Read the mount collection afresh, pooled ones cache their children
+	rootCol, err := a.getCollection(colPath)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return buckets, irodsToObjectError(err)
+	}
+	cols, err := a.retryIrods(func() (interface{}, error) {
+		return rootCol.Collections()
+	})
 	if err != nil {
 		logger.LogIf(ctx, err)
 		return buckets, irodsToObjectError(err)
 	}
 
-	for _, col := range cols {
+	for _, col := range cols.([]*gorods.Collection) {
 		buckets = append(buckets, minio.BucketInfo{
 			Name:    col.Name(),
 			Created: col.CreateTime(),
 		})
 	}
+	a.buckets.reset(buckets)
 
 	return buckets, nil
 }
 
 // DeleteBucket - delete a collection (bucket) in iRODS
 func (a *irodsObjects) DeleteBucket(ctx context.Context, bucket string) error {
-	var err error
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-	searchCol := col.FindCol(bucket)
-	if searchCol != nil {
-		err = searchCol.Destroy()
-	} else {
-		return minio.BucketNotFound{Bucket: bucket}
+	bucketCol, err := a.getBucketCol(bucket)
+	if err != nil {
+		return err
+	}
+
+	// The bucket collection is removed recursively, objects under lock
+	// included, so only empty buckets may go
+	empty, err := a.isBucketEmpty(bucket)
+	if err != nil {
+		logger.LogIf(ctx, err)
+		return irodsToObjectError(err, bucket)
+	}
+	if !empty {
+		return minio.BucketNotEmpty{Bucket: bucket}
 	}
 
-	go a.RefreshCols()
+	err = bucketCol.Destroy()
+	a.invalidateBucket(bucket)
+	if err == nil {
+		a.buckets.remove(bucket)
+	}
 
 	logger.LogIf(ctx, err)
 	return irodsToObjectError(err, bucket)
 }
 
+// isBucketEmpty returns true if no object is indexed in bucket.
+func (a *irodsObjects) isBucketEmpty(bucket string) (bool, error) {
+	if !a.pagedQueries {
+		rows, qErr := a.queryIndex(bucket, "")
+		return len(rows) == 0, qErr
+	}
+
+	rows, err := a.retryIrods(func() (interface{}, error) {
+		rows, _, _, qErr := a.queryIndexPage(bucket, "", "", 1)
+		return rows, qErr
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(rows.([][]string)) == 0, nil
+}
+
 // ListObjects - lists all blobs on irods with in a container filtered by prefix
 // and marker, uses Irods equivalent ListBlobs.
 // To accommodate S3-compatible applications using
@@ -346,18 +815,10 @@ func (a *irodsObjects) DeleteBucket(ctx context.Context, bucket string) error {
 // - Application supplied markers are used as-is to list
 //   object keys that appear after it in the lexicographical order.
 //
-// irodsIQuestQuery:
-// SELECT R_META_MAIN.meta_attr_value, R_DATA_MAIN.modify_ts, R_DATA_MAIN.data_size, R_DATA_MAIN.data_checksum, R_DATA_MAIN.data_name
-// FROM R_OBJT_METAMAP JOIN R_META_MAIN ON R_META_MAIN.meta_id = R_OBJT_METAMAP.meta_id
-// LEFT JOIN R_DATA_MAIN ON R_DATA_MAIN.data_id = R_OBJT_METAMAP.object_id
-// WHERE R_META_MAIN.meta_attr_name = ? AND R_META_MAIN.meta_attr_value LIKE ?
-// ORDER BY R_META_MAIN.meta_attr_value ASC
+// Objects are listed with irodsListQuery, see gateway-irods-query.go.
 //
 func (a *irodsObjects) ListObjects(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int) (result minio.ListObjectsInfo, err error) {
 
-	var objects []minio.ObjectInfo
-	var prefixes []string
-
 	// irodsListMarker := ""
 	// if isIrodsMarker(marker) {
 	// 	// If application is using Irods continuation token we should
@@ -365,58 +826,50 @@ func (a *irodsObjects) ListObjects(ctx context.Context, bucket, prefix, marker,
 	// 	irodsListMarker = strings.TrimPrefix(marker, irodsMarkerPrefix)
 	// }
 
-	metaPrefix := bucket + ":::::"
 	col := a.GetCol()
-	defer a.ReturnCol(col)
-	objs, qErr := col.Con().IQuestSQL(irodsIQuestQuery, irodsObjMetaAttr, metaPrefix+prefix+"%")
+	bucketPath := col.Path() + "/" + bucket
+	a.ReturnCol(col)
 
-	if qErr != nil {
-		return result, irodsToObjectError(fmt.Errorf("Error occured listing objects in %v", bucket), bucket, prefix)
+	// Browsing folders reads the prefix index where it is kept
+	if delimiter == irodsPrefixDelimiter && a.canListPrefixIndex(bucket, prefix) {
+		return a.listObjectsPrefixIndex(ctx, bucket, bucketPath, prefix, marker, maxKeys)
 	}
 
-	commonPrefixes := make(map[string]bool)
-
-	for _, blob := range objs {
-
-		if len(objects) >= maxKeys {
-			break
-		}
-
-		blobMetaMatch := blob[0]
-		blobName := strings.TrimPrefix(blobMetaMatch, metaPrefix)
-		blobUnixTime, _ := strconv.ParseInt(blob[1], 10, 64)
-		blobModTime := time.Unix(blobUnixTime, 0)
-		blobSize, _ := strconv.ParseInt(blob[2], 10, 64)
-		blobMD5 := blob[3]
+	// Let the catalog group keys into common prefixes where it can
+	if delimiter != "" && a.canListDelimited(bucket, prefix) {
+		return a.listObjectsDelimited(ctx, bucket, bucketPath, prefix, marker, delimiter, maxKeys)
+	}
+	if delimiter == "" && a.canListPaged(bucket, prefix, marker) {
+		return a.listObjectsPaged(ctx, bucket, bucketPath, prefix, marker, maxKeys)
+	}
 
-		if delimiter != "" && strings.Contains(blobName, delimiter) {
-			// Build common prefix
-			commonPrefix := prefix
-			for pos, char := range blobName {
+	return a.listObjectsFull(ctx, bucket, bucketPath, prefix, marker, delimiter, maxKeys)
+}
 
-				// Skip past the prefix
-				if pos < len(prefix) {
-					continue
-				}
+// listObjectsFull implements ListObjects by reading every key below prefix
+// and rolling them up into common prefixes in the gateway.
+func (a *irodsObjects) listObjectsFull(ctx context.Context, bucket, bucketPath, prefix, marker, delimiter string, maxKeys int) (result minio.ListObjectsInfo, err error) {
+	var objects []minio.ObjectInfo
+	var prefixes []string
 
-				commonPrefix += string(char)
+	objs, qErr := a.queryObjects(bucket, prefix)
 
-				if char == ([]rune(delimiter))[0] {
-					break
-				}
-			}
+	if qErr != nil {
+		return result, irodsToObjectError(irodsBackendError(qErr, fmt.Errorf("Error occured listing objects in %v", bucket)), bucket, prefix)
+	}
+	objs = dedupeIrodsObjectRows(objs)
 
-			blobWithoutPrefix := strings.TrimPrefix(blobName, prefix)
-			if strings.Contains(blobWithoutPrefix, delimiter) {
-				// Reduce duplicates
-				commonPrefixes[commonPrefix] = true
-				continue
-			}
+	// Keys and common prefixes count against maxKeys together, in key order
+	seenPrefixes := make(map[string]bool)
+	entries := 0
 
+	for _, blob := range objs {
+		if err = ctx.Err(); err != nil {
+			return result, err
 		}
+		blobName := blob[0]
 
-		if delimiter == "" && strings.HasPrefix(blobName, minio.GatewayMinioSysTmp) {
-			// We filter out minio.GatewayMinioSysTmp entries in the recursive listing.
+		if isIrodsSysTmp(blobName, prefix) {
 			continue
 		}
 		if !isIrodsMarker(marker) && blobName <= marker {
@@ -425,33 +878,29 @@ func (a *irodsObjects) ListObjects(ctx context.Context, bucket, prefix, marker,
 			continue
 		}
 
-		oi := minio.ObjectInfo{
-			Bucket:          bucket,
-			Name:            blobName,
-			ModTime:         blobModTime,
-			Size:            blobSize,
-			ETag:            getMD5Hash(blobMD5) + "-1",
-			ContentType:     getMime(blobName),
-			ContentEncoding: "",
+		commonPrefix, isPrefix := getCommonPrefix(blobName, prefix, delimiter)
+		if isPrefix && (seenPrefixes[commonPrefix] || (!isIrodsMarker(marker) && commonPrefix <= marker)) {
+			continue
 		}
-		objects = append(objects, oi)
-	}
 
-	// Need to implement common prefixes
-	for k := range commonPrefixes {
-		if k == minio.GatewayMinioSysTmp {
-			// We don't do strings.HasPrefix(blob.Name, minio.GatewayMinioSysTmp) here so that
-			// we can use tools like mc to inspect the contents of minio.sys.tmp/
-			// It is OK to allow listing of minio.sys.tmp/ in non-recursive mode as it aids in debugging.
-			continue
+		if entries >= maxKeys {
+			result.IsTruncated = true
+			break
 		}
-		if !isIrodsMarker(marker) && k <= marker {
-			// If the application used ListObjectsV1 style marker then we
-			// skip all the entries till we reach the marker.
+		entries++
+
+		if isPrefix {
+			seenPrefixes[commonPrefix] = true
+			prefixes = append(prefixes, commonPrefix)
+			result.NextMarker = commonPrefix
 			continue
 		}
+		objects = append(objects, a.rowObjectInfo(ctx, bucket, bucketPath, blob))
+		result.NextMarker = blobName
+	}
 
-		prefixes = append(prefixes, k)
+	if !result.IsTruncated {
+		result.NextMarker = ""
 	}
 
 	result.Objects = objects
@@ -467,6 +916,75 @@ func (a *irodsObjects) ListObjects(ctx context.Context, bucket, prefix, marker,
 	return result, nil
 }
 
+// getCommonPrefix returns the common prefix key rolls up into when listed
+// below prefix with delimiter: everything up to and including the first
+// delimiter after prefix. Works on bytes, a valid UTF-8 delimiter can't match
+// inside a multibyte character.
+func getCommonPrefix(key, prefix, delimiter string) (string, bool) {
+	if delimiter == "" || !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:len(prefix)+i+len(delimiter)], true
+}
+
+// isIrodsSysTmp returns true for keys and common prefixes in
+// minio.GatewayMinioSysTmp, which are only listed if the prefix asks for them
+// so tools like mc can still inspect its contents.
+func isIrodsSysTmp(name, prefix string) bool {
+	return strings.HasPrefix(name, minio.GatewayMinioSysTmp) && !strings.HasPrefix(prefix, minio.GatewayMinioSysTmp)
+}
+
+// rowObjectInfo converts a row returned by queryObjects into minio.ObjectInfo.
+func (a *irodsObjects) rowObjectInfo(ctx context.Context, bucket, bucketPath string, blob []string) minio.ObjectInfo {
+	blobName := blob[0]
+	blobUnixTime, _ := strconv.ParseInt(blob[1], 10, 64)
+	blobModTime := time.Unix(blobUnixTime, 0)
+	blobSize, _ := strconv.ParseInt(blob[2], 10, 64)
+
+	// Objects without a checksum yet get one on HEAD or GET, checksumming
+	// them here would read every such object the listing returns
+	blobETag := getMD5Hash(blob[3]) + "-1"
+	if blob[3] != "" {
+		if sum, sErr := parseIrodsChecksum(blob[3]); sErr == nil {
+			blobETag = sum.ETag()
+		} else {
+			logger.LogIf(ctx, sErr)
+		}
+	}
+
+	return minio.ObjectInfo{
+		Bucket:          bucket,
+		Name:            blobName,
+		ModTime:         blobModTime,
+		Size:            blobSize,
+		ETag:            blobETag,
+		ContentType:     getMime(blobName),
+		ContentEncoding: "",
+	}
+}
+
+// dedupeIrodsObjectRows keeps one row per key in rows sorted by key. A key has
+// several rows while an overwrite is being committed, or if an older gateway
+// left extra index AVUs behind. The live object is the one stored under
+// a hash of its key.
+func dedupeIrodsObjectRows(rows [][]string) [][]string {
+	deduped := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		if n := len(deduped); n > 0 && deduped[n-1][0] == row[0] {
+			if isIrodsObjectName(row[4], row[0]) {
+				deduped[n-1] = row
+			}
+			continue
+		}
+		deduped = append(deduped, row)
+	}
+	return deduped
+}
+
 // ListObjectsV2 - list all blobs in Irods bucket filtered by prefix
 func (a *irodsObjects) ListObjectsV2(ctx context.Context, bucket, prefix, continuationToken, delimiter string, maxKeys int, fetchOwner bool, startAfter string) (result minio.ListObjectsV2Info, err error) {
 	marker := continuationToken
@@ -506,9 +1024,13 @@ func (a *irodsObjects) GetObject(ctx context.Context, bucket, object string, sta
 		return oErr
 	}
 
-	reader := rodsObj.Reader()
+	if err := a.checkRodsObjScrubResult(ctx, bucket, object, rodsObj); err != nil {
+		return err
+	}
 
-	if _, err := io.Copy(writer, reader); err != nil {
+	// Stops once the client is gone, rather than when the pipe breaks
+	if _, err := copyIrods(ctx, writer, rodsObj.Reader()); err != nil {
+		rodsObj.Close()
 		return err
 	}
 
@@ -518,40 +1040,87 @@ func (a *irodsObjects) GetObject(ctx context.Context, bucket, object string, sta
 // GetObjectInfo - reads blob metadata properties and replies back minio.ObjectInfo,
 // uses zure equivalent GetBlobProperties.
 func (a *irodsObjects) GetObjectInfo(ctx context.Context, bucket, object string, opts cmd.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
-	metaPrefix := bucket + ":::::"
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-	objs, qErr := col.Con().IQuestSQL(irodsIQuestQuery, irodsObjMetaAttr, metaPrefix+object)
+	// Checksums are only returned if the client asked for them
+	checksumMode := isIrodsChecksumModeEnabled(opts.UserDefined)
+
+	if objInfo, ok := a.getCachedObjectInfo(bucket, object); ok {
+		return filterIrodsChecksums(objInfo, checksumMode), nil
+	}
+
+	gen := a.cache.generation()
+	objs, qErr := a.lookupObject(bucket, object)
 	if qErr != nil {
-		return objInfo, fmt.Errorf("Error occured listing object in %v", bucket)
+		return objInfo, irodsBackendError(qErr, fmt.Errorf("Error occured listing object in %v", bucket))
 	}
 
-	for _, blob := range objs {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+
+	for _, blob := range dedupeIrodsObjectRows(objs) {
 
-		blobMetaMatch := blob[0]
-		blobName := strings.TrimPrefix(blobMetaMatch, metaPrefix)
+		blobName := blob[0]
 		blobUnixTime, _ := strconv.ParseInt(blob[1], 10, 64)
 		blobModTime := time.Unix(blobUnixTime, 0)
 		blobSize, _ := strconv.ParseInt(blob[2], 10, 64)
-		blobMD5 := blob[3]
+		blobPath := col.Path() + "/" + bucket + "/" + blob[4]
 
-		return minio.ObjectInfo{
+		sum, sErr := a.getRodsObjChecksum(blobPath, blob[3])
+		if sErr != nil {
+			logger.LogIf(ctx, sErr)
+			return objInfo, irodsToObjectError(sErr, bucket, object)
+		}
+
+		objInfo = minio.ObjectInfo{
 			Bucket:          bucket,
 			Name:            blobName,
 			ModTime:         blobModTime,
 			Size:            blobSize,
-			ETag:            getMD5Hash(blobMD5) + "-1",
+			ETag:            sum.ETag(),
 			ContentType:     getMime(blobName),
 			ContentEncoding: "",
-		}, nil
+		}
+
+		// User defined metadata is stored on the data object
+		meta, mErr := a.retryIrods(func() (interface{}, error) {
+			rodsObj, oErr := col.Con().DataObject(blobPath)
+			if oErr != nil {
+				return nil, oErr
+			}
+			return getIrodsObjectMeta(rodsObj)
+		})
+		if isIrodsBackendDown(mErr) {
+			return objInfo, mErr
+		}
+		if mErr == nil {
+			userDefined := meta.(map[string]string)
+			objInfo.UserDefined = userDefined
+			if contentType, ok := getUserDefined(userDefined, "Content-Type"); ok {
+				objInfo.ContentType = contentType
+			}
+			objInfo.StorageClass, _ = getUserDefined(userDefined, amzStorageClass)
+		}
+		objInfo.UserDefined = sum.AddUserDefined(objInfo.UserDefined)
+
+		a.cacheObjectInfo(objInfo, gen)
+		return filterIrodsChecksums(objInfo, checksumMode), nil
 	}
 
-	return objInfo, fmt.Errorf("Error occured finding object in %v", bucket)
+	return objInfo, minio.ObjectNotFound{Bucket: bucket, Object: object}
 
 }
 
 // GetObjectNInfo - returns object info and locked object ReadCloser
 func (a *irodsObjects) GetObjectNInfo(ctx context.Context, bucket, object string, rs *minio.HTTPRangeSpec, h http.Header, lockType minio.LockType, opts minio.ObjectOptions) (gr *minio.GetObjectReader, err error) {
+	// GET passes x-amz-checksum-mode in the request headers
+	if mode := h.Get(amzChecksumMode); mode != "" {
+		userDefined := make(map[string]string, len(opts.UserDefined)+1)
+		for k, v := range opts.UserDefined {
+			userDefined[k] = v
+		}
+		userDefined[amzChecksumMode] = mode
+		opts.UserDefined = userDefined
+	}
+
 	var objInfo minio.ObjectInfo
 	objInfo, err = a.GetObjectInfo(ctx, bucket, object, opts)
 	if err != nil {
@@ -564,8 +1133,20 @@ func (a *irodsObjects) GetObjectNInfo(ctx context.Context, bucket, object string
 		return nil, err
 	}
 
+	// Refuse corrupt objects before the response is started
+	if a.scrubRefuseCorrupt {
+		if rodsObj, oErr := a.getObjectInBucket(bucket, object); oErr == nil {
+			if err = a.checkRodsObjScrubResult(ctx, bucket, object, rodsObj); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	pr, pw := io.Pipe()
 	go func() {
+		// A write blocked on a client that went away fails once ctx is done
+		stop := closePipeOnCancel(ctx, pw)
+		defer stop()
 		err := a.GetObject(ctx, bucket, object, startOffset, length, pw, objInfo.ETag, opts)
 		pw.CloseWithError(err)
 	}()
@@ -575,129 +1156,413 @@ func (a *irodsObjects) GetObjectNInfo(ctx context.Context, bucket, object string
 	return minio.NewGetObjectReaderFromReader(pr, objInfo, opts.CheckCopyPrecondFn, pipeCloser)
 }
 
-func (a *irodsObjects) createRodsObj(bucket, object string, isListableObj bool) (*gorods.DataObj, error) {
-	var destObj *gorods.DataObj
-	acol := a.GetCol()
-	defer a.ReturnCol(acol)
-	col := acol.FindCol(bucket)
-	if col == nil {
-		return nil, fmt.Errorf("Can't find bucket %v", bucket)
+// createRodsObj creates an unlisted data object, such as a multipart upload
+// marker, named name in the bucket collection.
+func (a *irodsObjects) createRodsObj(bucket, name string) (*gorods.DataObj, error) {
+	col, err := a.getBucketCol(bucket)
+	if err != nil {
+		return nil, err
 	}
 
-	objName := getMD5Hash(object)
+	return col.CreateDataObj(gorods.DataObjOptions{
+		Name: name,
+	})
+}
 
-	if !isListableObj {
-		objName = object
+// createTmpRodsObj creates a hidden data object in the bucket collection for
+// new object data to be written to. It only becomes visible as an S3 object
+// through commitRodsObj.
+func (a *irodsObjects) createTmpRodsObj(bucket string) (*gorods.DataObj, error) {
+	tmpID, err := getIrodsUploadID()
+	if err != nil {
+		return nil, err
 	}
 
-	var cErr error
-	destObj, cErr = col.CreateDataObj(gorods.DataObjOptions{
-		Name: objName,
-	})
-	if cErr != nil {
+	bucketCol, err := a.getBucketCol(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The name is unique to this write, so the create can be retried. An
+	// attempt whose reply was lost has created the object already.
+	name := fmt.Sprintf(tmpObjectNameTemplate, tmpID)
+	val, err := a.retryIrods(func() (interface{}, error) {
+		tmpObj, cErr := bucketCol.CreateDataObj(gorods.DataObjOptions{
+			Name: name,
+		})
+		if cErr == nil {
+			return tmpObj, nil
+		}
+		col := a.GetCol()
+		defer a.ReturnCol(col)
+		if rodsObj, oErr := col.Con().DataObject(bucketCol.Path() + "/" + name); oErr == nil {
+			return rodsObj, nil
+		}
 		return nil, cErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	tmpObj := val.(*gorods.DataObj)
+
+	// Lets the janitor remove the object if the write never finishes
+	if mErr := markRodsObjIncomplete(tmpObj); mErr != nil {
+		tmpObj.Destroy()
+		return nil, mErr
+	}
+
+	return tmpObj, nil
+}
+
+// commitRodsObj publishes a fully written temporary object as object. The
+// data object is renamed to the hashed key and then given the index AVU that
+// makes it visible to listings.
+//
+// Overwrites are last writer wins. The temporary object already carries all of
+// the new metadata, so content and metadata are replaced together: the previous
+// object is renamed aside, the new one renamed into place and only then is the
+// previous object, with its stale minio_meta_ and minio_obj AVUs, destroyed.
+// Until the new object is indexed lookups find the previous one under its
+// aside name, see getAsideObjectInBucket. If the new object can't be
+// published it is renamed back to its temporary name and the previous object
+// restored. Once it is published the commit succeeds, a previous object that
+// can't be destroyed is left to the janitor.
+func (a *irodsObjects) commitRodsObj(ctx context.Context, bucket, object string, tmpObj *gorods.DataObj) (*gorods.DataObj, error) {
+	objName := a.getObjectName(object)
+	tmpName := tmpObj.Name()
+	defer a.invalidateObject(bucket, object)
+
+	rodsObj, oErr := a.getObjectInBucket(bucket, object)
+	if isIrodsBackendDown(oErr) {
+		return nil, oErr
+	}
+	// The previous version of a concurrent commit is left to that commit
+	if oErr == nil && strings.HasSuffix(rodsObj.Name(), irodsAsideSuffix) {
+		oErr = minio.ObjectNotFound{Bucket: bucket, Object: object}
+	}
+	if oErr != nil {
+		// A concurrent commit of the same key may not have indexed its
+		// object yet, it is replaced like any previous object
+		if pending, pErr := a.getDataObjInBucket(bucket, objName); pErr == nil {
+			if key, ok := getRodsObjKey(pending, bucket); ok && key != object {
+				return nil, fmt.Errorf("Data object name %v for %v/%v is taken by another key", objName, bucket, object)
+			}
+			rodsObj, oErr = pending, nil
+		}
+	}
+
+	var oldObj *gorods.DataObj
+	var oldName string
+	if oErr == nil {
+		if rErr := a.reclaimRodsObj(rodsObj); rErr != nil {
+			return nil, rErr
+		}
+		oldName = rodsObj.Name()
+		asideName := tmpName + irodsAsideSuffix
+		if rErr := rodsObj.Rename(asideName); rErr != nil {
+			return nil, rErr
+		}
+		if oldObj, oErr = a.getDataObjInBucket(bucket, asideName); oErr != nil {
+			return nil, oErr
+		}
+		// Lets the janitor remove it if we die before destroying it
+		if mErr := markRodsObjIncomplete(oldObj); mErr != nil {
+			return nil, mErr
+		}
+	}
+
+	// Put the previous object back if the new one can't be committed
+	restoreOld := func() {
+		if oldObj != nil {
+			logger.LogIf(ctx, oldObj.Rename(oldName))
+			logger.LogIf(ctx, markRodsObjComplete(oldObj))
+		}
+	}
+
+	if rErr := tmpObj.Rename(objName); rErr != nil {
+		restoreOld()
+		return nil, rErr
+	}
+
+	// Moves the new object back to its temporary name, where the caller
+	// destroys it, and restores the previous one
+	rollback := func(err error) (*gorods.DataObj, error) {
+		newObj, oErr := a.getDataObjInBucket(bucket, objName)
+		if oErr == nil {
+			oErr = newObj.Rename(tmpName)
+		}
+		if oErr != nil {
+			// Both versions are kept, the previous one under its aside name
+			logger.LogIf(ctx, fmt.Errorf("Unable to roll back the commit of %v/%v: %v", bucket, object, oErr))
+			if oldObj != nil {
+				logger.LogIf(ctx, markRodsObjComplete(oldObj))
+			}
+			return nil, err
+		}
+		restoreOld()
+		return nil, err
+	}
+
+	destObj, oErr := a.getDataObjInBucket(bucket, objName)
+	if oErr != nil {
+		return rollback(oErr)
+	}
+	if mErr := a.addObjectIndex(destObj, bucket, object); mErr != nil {
+		return rollback(mErr)
+	}
+	if mErr := a.addPrefixIndex(destObj, bucket, object); mErr != nil {
+		return rollback(mErr)
+	}
+	// The janitor would reap the published object if the tag stayed
+	if _, mErr := a.retryIrods(func() (interface{}, error) {
+		return nil, markRodsObjComplete(destObj)
+	}); mErr != nil {
+		return rollback(mErr)
+	}
+
+	if oldObj != nil {
+		logger.LogIf(ctx, oldObj.Destroy())
+	}
+
+	return destObj, nil
+}
+
+// applyIrodsObjectMeta stores user defined metadata as minio_meta_ AVUs.
+// Object lock, tagging and checksum headers are kept in their own AVUs.
+func applyIrodsObjectMeta(obj *gorods.DataObj, userDefined map[string]string) error {
+	for k, v := range userDefined {
+		if isIrodsObjectLockHeader(k) || strings.EqualFold(k, amzTagging) || isIrodsChecksumHeader(k) {
+			continue
+		}
+		if _, err := obj.AddMeta(gorods.Meta{
+			irodsMetaAttrPrefix + k, // Attribute
+			v,                       // Value
+			"",                      // Unit
+			nil,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getIrodsObjectMeta reads the user defined metadata stored by applyIrodsObjectMeta,
+// along with any flexible checksums as x-amz-checksum-* headers and the
+// storage class lifecycle rules moved the object to as x-amz-storage-class.
+func getIrodsObjectMeta(obj *gorods.DataObj) (map[string]string, error) {
+	mc, err := obj.Meta()
+	if err != nil {
+		return nil, err
+	}
+	metas, err := mc.All()
+	if err != nil {
+		return nil, err
 	}
 
-	if isListableObj {
-		_, mErr := destObj.AddMeta(gorods.Meta{
-			irodsObjMetaAttr, bucket + ":::::" + object, "", nil,
-		})
-		if mErr != nil {
-			return nil, mErr
+	userDefined := make(map[string]string)
+	for _, m := range metas {
+		if strings.HasPrefix(m.Attribute, irodsMetaAttrPrefix) {
+			userDefined[strings.TrimPrefix(m.Attribute, irodsMetaAttrPrefix)] = m.Value
+		} else if strings.HasPrefix(m.Attribute, irodsChecksumMetaAttrPrefix) {
+			userDefined[irodsFlexChecksumHeader(strings.TrimPrefix(m.Attribute, irodsChecksumMetaAttrPrefix))] = m.Value
+		} else if m.Attribute == irodsStorageClassMetaAttr {
+			userDefined[amzStorageClass] = m.Value
 		}
 	}
-
-	return destObj, nil
+	return userDefined, nil
 }
 
-func (a *irodsObjects) getOrCreateRodsObj(bucket, object string, isListableObj bool) (*gorods.DataObj, error) {
-	var destObj *gorods.DataObj
-
-	if rodsObj, oErr := a.getObjectInBucket(bucket, object); oErr != nil {
-		return a.createRodsObj(bucket, object, isListableObj)
+// PutObject - Create a new data object with the incoming data.
+func (a *irodsObjects) PutObject(ctx context.Context, bucket, object string, data *minio.PutObjReader, opts cmd.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	if err = checkObjectKey(bucket, object); err != nil {
+		return objInfo, err
+	}
 
-	} else {
-		destObj = rodsObj
+	lock, lErr := parseIrodsObjectLock(bucket, object, opts.UserDefined)
+	if lErr != nil {
+		return objInfo, lErr
 	}
 
-	return destObj, nil
-}
+	flexSum, fErr := getIrodsFlexChecksum(bucket, object, opts.UserDefined)
+	if fErr != nil {
+		return objInfo, fErr
+	}
 
-// PutObject - Create a new data object with the incoming data.
-func (a *irodsObjects) PutObject(ctx context.Context, bucket, object string, data *minio.PutObjReader, opts cmd.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	// Refuse to overwrite objects under retention or legal hold
+	if err = a.checkObjectLock(ctx, bucket, object); err != nil {
+		return objInfo, err
+	}
 
-	// Get reference to iRODS data object
-	destObj, gErr := a.createRodsObj(bucket, object, true)
+	// Data is written to a hidden object first, readers never see partial content
+	tmpObj, gErr := a.createTmpRodsObj(bucket)
 	if gErr != nil {
 		return objInfo, gErr
 	}
+	defer func() {
+		if err != nil {
+			tmpObj.Destroy()
+		}
+	}()
 
 	// Get *gorods.Writer interface and copy data
-	writer := destObj.Writer()
-	_, wErr := io.Copy(writer, data)
+	// The received data is hashed with SHA-256 for zones that checksum with it
+	received := sha256.New()
+	var reader io.Reader = io.TeeReader(data, received)
+	if flexSum != nil {
+		reader = flexSum.Reader(reader)
+	}
+	writer := tmpObj.Writer()
+	_, wErr := copyIrods(ctx, writer, reader)
+	tmpObj.Close()
 	if wErr != nil {
 		return objInfo, wErr
 	}
-	destObj.Close()
-
-	// Add metadata
-	// for k, v := range metadata {
-	// 	if _, mErr := destObj.AddMeta(gorods.Meta{
-	// 		"minio_meta_" + k, // Attribute
-	// 		v,                 // Value
-	// 		"",                // Unit
-	// 		nil,
-	// 	}); mErr != nil {
-	// 		return objInfo, mErr
-	// 	}
-	// }
 
-	md5, cErr := destObj.Chksum()
+	// Compare what iRODS stored with what the client sent
+	sum, cErr := verifyRodsObjChecksum(tmpObj, data, received, opts.UserDefined)
 	if cErr != nil {
+		logger.LogIf(ctx, cErr)
 		return objInfo, cErr
 	}
 
+	var userDefined map[string]string
+	if flexSum != nil {
+		if err = flexSum.Verify(); err != nil {
+			logger.LogIf(ctx, err)
+			return objInfo, err
+		}
+		if err = flexSum.Store(tmpObj, flexSum.Sum()); err != nil {
+			return objInfo, err
+		}
+		userDefined = map[string]string{irodsFlexChecksumHeader(flexSum.Algorithm): flexSum.Sum()}
+	}
+
+	if err = applyIrodsObjectMeta(tmpObj, opts.UserDefined); err != nil {
+		return objInfo, err
+	}
+
+	if err = a.applyObjectLock(ctx, tmpObj, lock); err != nil {
+		return objInfo, err
+	}
+
+	if err = applyIrodsObjectTags(tmpObj, opts.UserDefined); err != nil {
+		return objInfo, err
+	}
+
+	// A cancelled upload must not replace the current object
+	if err = ctx.Err(); err != nil {
+		return objInfo, err
+	}
+
+	destObj, pErr := a.commitRodsObj(ctx, bucket, object, tmpObj)
+	if pErr != nil {
+		return objInfo, pErr
+	}
+
+	// Sealing is best effort, the lock is still enforced by the gateway if
+	// iRODS refuses the change
+	logger.LogIf(ctx, a.sealRodsObj(destObj, lock))
+
 	return minio.ObjectInfo{
 		Bucket:          bucket,
 		Name:            object,
 		ModTime:         destObj.ModTime(),
 		Size:            data.Size(),
-		ETag:            getMD5Hash(md5) + "-1",
+		ETag:            sum.ETag(),
 		ContentType:     getMime(object),
 		ContentEncoding: "",
+		UserDefined:     sum.AddUserDefined(userDefined),
 	}, nil
 }
 
 // CopyObject - Copies a blob from source container to destination container.
 // Uses Irods equivalent CopyBlob API.
 func (a *irodsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, destBucket, destObject string, srcInfo minio.ObjectInfo, srcOpts, dstOpts cmd.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	if err = checkObjectKey(destBucket, destObject); err != nil {
+		return objInfo, err
+	}
+
+	lock, lErr := parseIrodsObjectLock(destBucket, destObject, srcInfo.UserDefined)
+	if lErr != nil {
+		return objInfo, lErr
+	}
 
-	// TODO: Remember to handle srcInfo... it's metadata for dest obj or something
-	srcObj, sErr := a.getOrCreateRodsObj(srcBucket, srcObject, true)
+	if err = a.checkObjectLock(ctx, destBucket, destObject); err != nil {
+		return objInfo, err
+	}
+
+	srcObj, sErr := a.getObjectInBucket(srcBucket, srcObject)
 	if sErr != nil {
-		return objInfo, sErr
+		return objInfo, minio.ObjectNotFound{Bucket: srcBucket, Object: srcObject}
 	}
 
-	destObj, dErr := a.createRodsObj(destBucket, destObject, true)
+	tmpObj, dErr := a.createTmpRodsObj(destBucket)
 	if dErr != nil {
 		return objInfo, dErr
 	}
+	defer func() {
+		if err != nil {
+			tmpObj.Destroy()
+		}
+	}()
 
-	size, cErr := io.Copy(destObj.Writer(), srcObj.Reader())
+	size, cErr := copyIrods(ctx, tmpObj.Writer(), srcObj.Reader())
+	srcObj.Close()
+	tmpObj.Close()
 	if cErr != nil {
 		return objInfo, cErr
 	}
 
-	chkSum, _ := destObj.Chksum()
+	chkSum, kErr := tmpObj.Chksum()
+	if kErr != nil {
+		return objInfo, kErr
+	}
+	sum, pErr := parseIrodsChecksum(chkSum)
+	if pErr != nil {
+		return objInfo, pErr
+	}
+
+	// srcInfo.UserDefined holds the destination's metadata, either copied
+	// from the source or replaced by the request
+	if err = applyIrodsObjectMeta(tmpObj, srcInfo.UserDefined); err != nil {
+		return objInfo, err
+	}
+
+	if err = a.applyObjectLock(ctx, tmpObj, lock); err != nil {
+		return objInfo, err
+	}
+
+	if err = applyIrodsObjectTags(tmpObj, srcInfo.UserDefined); err != nil {
+		return objInfo, err
+	}
+
+	// The data is the same, so are its flexible checksums
+	if err = copyIrodsFlexChecksums(srcObj, tmpObj); err != nil {
+		return objInfo, err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return objInfo, err
+	}
+
+	destObj, mErr := a.commitRodsObj(ctx, destBucket, destObject, tmpObj)
+	if mErr != nil {
+		return objInfo, mErr
+	}
+
+	// Sealing is best effort, the lock is still enforced by the gateway if
+	// iRODS refuses the change
+	logger.LogIf(ctx, a.sealRodsObj(destObj, lock))
 
 	return minio.ObjectInfo{
 		Bucket:          destBucket,
 		Name:            destObject,
 		ModTime:         destObj.ModTime(),
 		Size:            int64(size),
-		ETag:            getMD5Hash(chkSum) + "-1",
+		ETag:            sum.ETag(),
 		ContentType:     getMime(destObject),
 		ContentEncoding: "",
+		UserDefined:     sum.AddUserDefined(nil),
 	}, nil
 
 }
@@ -709,7 +1574,27 @@ func (a *irodsObjects) DeleteObject(ctx context.Context, bucket, object string)
 		return oErr
 	}
 
-	return rodsObj.Destroy()
+	lock, lErr := readIrodsObjectLock(rodsObj)
+	if lErr != nil {
+		logger.LogIf(ctx, lErr)
+		return irodsToObjectError(lErr, bucket, object)
+	}
+	if lock.IsActive(time.Now()) {
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+	}
+	if rErr := a.reclaimRodsObj(rodsObj); rErr != nil {
+		logger.LogIf(ctx, rErr)
+		return rErr
+	}
+
+	if dErr := rodsObj.Destroy(); dErr != nil {
+		return dErr
+	}
+	a.invalidateObject(bucket, object)
+
+	// Empty folders left in the prefix index are only listed, never wrong
+	logger.LogIf(ctx, a.removePrefixIndex(bucket, object))
+	return nil
 }
 
 // DeleteObject - Deletes data object in iRODS
@@ -738,6 +1623,53 @@ func getIrodsMetadataObjectName(objectName, uploadID string) string {
 	return fmt.Sprintf(metadataObjectNameTemplate, uploadID, getMD5Hash(objectName))
 }
 
+// Returns the upload ID of a multipart metadata object name, ok is false if
+// name is not a multipart metadata object.
+func parseIrodsMetadataObjectName(name string) (uploadID string, ok bool) {
+	if !strings.HasPrefix(name, "multipart_v1_") || !strings.HasSuffix(name, "_irods.json") {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, "multipart_v1_"), "_")
+	if len(parts) != 3 {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// irodsUploadMarker is the metadata object of a multipart upload.
+type irodsUploadMarker struct {
+	UploadID string
+	Name     string
+	ModTime  time.Time
+	Size     int64
+}
+
+// queryUploadMarkers returns the metadata objects of the multipart uploads in
+// bucket, found by their minio_upload AVU. Markers written before uploads
+// were tagged are not returned.
+func (a *irodsObjects) queryUploadMarkers(bucket string) ([]irodsUploadMarker, error) {
+	rows, err := a.catalog.queryMetaPrefix(irodsUploadMetaAttr, bucket, "")
+	if err != nil {
+		return nil, err
+	}
+
+	markers := make([]irodsUploadMarker, 0, len(rows))
+	for _, row := range rows {
+		if _, ok := parseIrodsMetadataObjectName(row[4]); !ok {
+			continue
+		}
+		modTime, _ := parseIrodsTimestamp(row[1])
+		size, _ := strconv.ParseInt(row[2], 10, 64)
+		markers = append(markers, irodsUploadMarker{
+			UploadID: row[0],
+			Name:     row[4],
+			ModTime:  modTime,
+			Size:     size,
+		})
+	}
+	return markers, nil
+}
+
 func checkIrodsUploadID(ctx context.Context, uploadID string) (err error) {
 	if len(uploadID) != 16 {
 		logger.LogIf(ctx, minio.MalformedUploadID{
@@ -792,6 +1724,10 @@ func (mm irodsMultipartMetadata) ToJSON() ([]byte, error) {
 
 // NewMultipartUpload - Use Irods equivalent CreateBlockBlob.
 func (a *irodsObjects) NewMultipartUpload(ctx context.Context, bucket, object string, opts cmd.ObjectOptions) (uploadID string, err error) {
+	if err = checkObjectKey(bucket, object); err != nil {
+		return "", err
+	}
+
 	uploadID, err = getIrodsUploadID()
 	if err != nil {
 		logger.LogIf(ctx, err)
@@ -799,20 +1735,41 @@ func (a *irodsObjects) NewMultipartUpload(ctx context.Context, bucket, object st
 	}
 	metadataObject := getIrodsMetadataObjectName(object, uploadID)
 
-	// mp := irodsMultipartMetadata{Name: object, Metadata: metadata}
-	// jsonData, jErr := mp.ToJSON()
-	// if jErr != nil {
-	// 	return "", jErr
-	// }
+	// Validate lock headers up front, they are applied on completion
+	if _, err = parseIrodsObjectLock(bucket, object, opts.UserDefined); err != nil {
+		return "", err
+	}
+
+	mp := irodsMultipartMetadata{Name: object, Metadata: opts.UserDefined}
+	jsonData, jErr := mp.ToJSON()
+	if jErr != nil {
+		return "", jErr
+	}
 
-	_, cErr := a.createRodsObj(bucket, metadataObject, false)
+	rodsObj, cErr := a.createRodsObj(bucket, metadataObject)
 	if cErr != nil {
 		return "", cErr
 	}
 
-	// if wErr := rodsObj.Write(jsonData); wErr != nil {
-	// 	return "", wErr
-	// }
+	if wErr := rodsObj.Write(jsonData); wErr != nil {
+		return "", wErr
+	}
+
+	// Tagged so the uploads of a bucket can be found in the catalog
+	if _, tErr := rodsObj.AddMeta(gorods.Meta{
+		irodsUploadMetaAttr, uploadID, bucket, nil,
+	}); tErr != nil {
+		return "", tErr
+	}
+
+	// Parts of this upload are kept in their own collection
+	mpCol, mErr := a.getMultipartCol(bucket)
+	if mErr != nil {
+		return "", mErr
+	}
+	if _, sErr := mpCol.CreateSubCollection(uploadID); sErr != nil {
+		return "", sErr
+	}
 
 	return uploadID, nil
 
@@ -827,6 +1784,87 @@ func (a *irodsObjects) getMultipartCol(bucket string) (*gorods.Collection, error
 	})
 }
 
+// getUploadCol returns {bucket}/multiparts/{uploadID}, which holds the parts of
+// a single upload. Uploads started before parts were kept per upload don't have
+// one, in which case it is created.
+func (a *irodsObjects) getUploadCol(bucket, uploadID string) (*gorods.Collection, error) {
+	mpCol, mErr := a.getMultipartCol(bucket)
+	if mErr != nil {
+		return nil, mErr
+	}
+
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+	uploadCol, err := col.Con().Collection(gorods.CollectionOptions{
+		Path: mpCol.Path() + "/" + uploadID,
+	})
+	if err == nil {
+		return uploadCol, nil
+	}
+
+	return mpCol.CreateSubCollection(uploadID)
+}
+
+// getUploadPart finds part partID of an upload. Parts written before uploads
+// had their own collection live in multiparts/ as md5(object)_partID, shared by
+// all uploads of the key, and only match if their minio_multipart AVU names
+// this upload.
+func (a *irodsObjects) getUploadPart(bucket, object, uploadID string, partID int) (*gorods.DataObj, error) {
+	col := a.GetCol()
+	defer a.ReturnCol(col)
+	mpColPath := col.Path() + "/" + bucket + "/" + irodsMultipartSubCol
+
+	if partObj, err := col.Con().DataObject(mpColPath + "/" + uploadID + "/" + strconv.Itoa(partID)); err == nil {
+		return partObj, nil
+	}
+
+	partObj, err := col.Con().DataObject(mpColPath + "/" + getMD5Hash(object) + "_" + strconv.Itoa(partID))
+	if err != nil {
+		return nil, minio.InvalidPart{PartNumber: partID}
+	}
+
+	metas, _ := partObj.Attribute(irodsMultipartMetaAttr)
+	for _, m := range metas {
+		if m.Value == uploadID {
+			return partObj, nil
+		}
+	}
+
+	return nil, minio.InvalidPart{PartNumber: partID}
+}
+
+// Removes every part of an upload, leaving parts of other uploads of the same
+// key alone.
+func (a *irodsObjects) removeUploadParts(bucket, uploadID string) error {
+	mpCol, mErr := a.getMultipartCol(bucket)
+	if mErr != nil {
+		return mErr
+	}
+
+	// Parts written with the shared multiparts/ layout
+	partsQ, qErr := a.queryMetaValue(irodsMultipartMetaAttr, uploadID)
+	if qErr != nil {
+		return qErr
+	}
+	for _, partSlc := range partsQ {
+		partObjName := partSlc[4]
+		if !strings.Contains(partObjName, "_") {
+			continue
+		}
+		if partObj := mpCol.FindObj(partObjName); partObj != nil {
+			if dErr := partObj.Destroy(); dErr != nil {
+				return dErr
+			}
+		}
+	}
+
+	if uploadCol := mpCol.FindCol(uploadID); uploadCol != nil {
+		return uploadCol.Destroy()
+	}
+
+	return nil
+}
+
 // PutObjectPart - Use Irods equivalent PutBlockWithLength.
 func (a *irodsObjects) PutObjectPart(ctx context.Context, bucket, object, uploadID string, partID int, data *minio.PutObjReader, opts cmd.ObjectOptions) (info minio.PartInfo, err error) {
 	if err = a.checkUploadIDExists(ctx, bucket, object, uploadID); err != nil {
@@ -837,40 +1875,89 @@ func (a *irodsObjects) PutObjectPart(ctx context.Context, bucket, object, upload
 		return info, err
 	}
 
-	etag := data.MD5HexString()
-	if etag == "" {
-		etag = minio.GenETag()
+	if partID < 1 || partID > irodsS3MaxPartID {
+		logger.LogIf(ctx, minio.InvalidPart{PartNumber: partID})
+		return info, minio.InvalidPart{PartNumber: partID}
 	}
 
-	// get access to multipart sub collection
-	mpCol, mErr := a.getMultipartCol(bucket)
+	flexSum, fErr := getIrodsFlexChecksum(bucket, object, opts.UserDefined)
+	if fErr != nil {
+		return info, fErr
+	}
+
+	// get access to the upload's sub collection
+	uploadCol, mErr := a.getUploadCol(bucket, uploadID)
 	if mErr != nil {
 		return info, mErr
 	}
 
+	// Uploading a part number again replaces the earlier part
+	partObjName := strconv.Itoa(partID)
+	if oldPart := uploadCol.FindObj(partObjName); oldPart != nil {
+		if dErr := oldPart.Destroy(); dErr != nil {
+			return info, dErr
+		}
+	}
+
 	// Create object and write data to it
-	partObjName := getMD5Hash(object) + "_" + strconv.Itoa(partID)
-	partObj, cErr := mpCol.CreateDataObj(gorods.DataObjOptions{
+	partObj, cErr := uploadCol.CreateDataObj(gorods.DataObjOptions{
 		Name: partObjName,
 	})
 	if cErr != nil {
 		return info, cErr
 	}
+	// The received data is hashed with SHA-256 for zones that checksum with it
+	received := sha256.New()
+	var reader io.Reader = io.TeeReader(data, received)
+	if flexSum != nil {
+		reader = flexSum.Reader(reader)
+	}
 	writer := partObj.Writer()
 
-	written, zErr := io.Copy(writer, data)
+	written, zErr := copyIrods(ctx, writer, reader)
 	if zErr != nil {
+		partObj.Close()
+		partObj.Destroy()
 		return info, zErr
 	}
 
 	partObj.Close()
 
-	// Add the upload ID as metadata
+	// The part ETag is the MD5 of the data received, CompleteMultipartUpload
+	// checks the client's list against it
+	etag := data.MD5CurrentHexString()
+
+	// Add the upload ID and ETag as metadata
 	if _, mErr := partObj.AddMeta(gorods.Meta{
 		irodsMultipartMetaAttr, uploadID, "", nil,
 	}); mErr != nil {
 		return info, mErr
 	}
+	if _, mErr := partObj.AddMeta(gorods.Meta{
+		irodsETagMetaAttr, etag, "", nil,
+	}); mErr != nil {
+		return info, mErr
+	}
+
+	// Registers the checksum, so ListObjectParts reports the same ETag, and
+	// compares it with what the client sent
+	if _, cErr := verifyRodsObjChecksum(partObj, data, received, opts.UserDefined); cErr != nil {
+		logger.LogIf(ctx, cErr)
+		partObj.Destroy()
+		return info, cErr
+	}
+
+	// The part checksum is kept for the composite checksum of the object
+	if flexSum != nil {
+		if cErr := flexSum.Verify(); cErr != nil {
+			logger.LogIf(ctx, cErr)
+			partObj.Destroy()
+			return info, cErr
+		}
+		if mErr := flexSum.Store(partObj, flexSum.Sum()); mErr != nil {
+			return info, mErr
+		}
+	}
 
 	info.PartNumber = partID
 	info.ETag = etag
@@ -892,9 +1979,7 @@ func (a *irodsObjects) ListObjectParts(ctx context.Context, bucket, object, uplo
 	result.UploadID = uploadID
 	result.MaxParts = maxParts
 
-	col := a.GetCol()
-	defer a.ReturnCol(col)
-	partsQ, qErr := col.Con().IQuestSQL(irodsIQuestQuery, irodsMultipartMetaAttr, uploadID)
+	partsQ, qErr := a.queryMetaValue(irodsMultipartMetaAttr, uploadID)
 	if qErr != nil {
 		return result, qErr
 	}
@@ -908,15 +1993,29 @@ func (a *irodsObjects) ListObjectParts(ctx context.Context, bucket, object, uplo
 		partSize, _ := strconv.ParseInt(partSlc[2], 10, 64)
 		partMD5 := partSlc[3]
 		partObjName := partSlc[4]
-		partNumber, cErr := strconv.Atoi(strings.Split(partObjName, "_")[1])
+		// Either {partID} or legacy {md5(object)}_{partID}
+		partNumber, cErr := strconv.Atoi(partObjName[strings.LastIndex(partObjName, "_")+1:])
 		if cErr != nil {
 			return result, cErr
 		}
 
+		// On MD5 zones data_checksum is the part's MD5. Otherwise use the
+		// MD5 recorded on upload, or checksum parts stored without one.
+		partETag := getMD5Hash(partMD5) + "-1"
+		if sum, sErr := parseIrodsChecksum(partMD5); sErr == nil && sum.Algorithm == irodsChecksumMD5 {
+			partETag = sum.Hex()
+		} else if partObj, pErr := a.getUploadPart(bucket, object, uploadID, partNumber); pErr == nil {
+			if metas, _ := partObj.Attribute(irodsETagMetaAttr); len(metas) > 0 {
+				partETag = metas[0].Value
+			} else if sum, sErr := a.getRodsObjChecksum(partObj.Path(), partMD5); sErr == nil {
+				partETag = sum.ETag()
+			}
+		}
+
 		partsMap[partNumber] = minio.PartInfo{
 			PartNumber: partNumber,
 			Size:       partSize,
-			ETag:       getMD5Hash(partMD5) + "-1",
+			ETag:       partETag,
 		}
 
 	}
@@ -967,28 +2066,68 @@ func (a *irodsObjects) AbortMultipartUpload(ctx context.Context, bucket, object,
 		return oErr
 	}
 
-	// Get reference to {bucket}/multiparts
-	mpCol, mErr := a.getMultipartCol(bucket)
-	if mErr != nil {
-		return mErr
+	// Delete this upload's parts only
+	if err = a.removeUploadParts(bucket, uploadID); err != nil {
+		return err
 	}
 
-	objHash := getMD5Hash(object)
+	return rodsObj.Destroy()
 
-	// Delete parts
-	if err = mpCol.Each(func(partObj gorods.IRodsObj) error {
-		if strings.HasPrefix(partObj.Name(), objHash) {
-			if dErr := partObj.Destroy(); dErr != nil {
-				return dErr
+}
+
+// getCompleteParts checks the client's part list against the stored parts and
+// returns them in order. Enforces S3's part number range, ordering, minimum
+// part size for all but the last part and ETag matching.
+func (a *irodsObjects) getCompleteParts(ctx context.Context, bucket, object, uploadID string, uploadedParts []minio.CompletePart) ([]*gorods.DataObj, error) {
+	if len(uploadedParts) == 0 {
+		logger.LogIf(ctx, minio.InvalidPart{})
+		return nil, minio.InvalidPart{}
+	}
+
+	partObjs := make([]*gorods.DataObj, 0, len(uploadedParts))
+	for i, cPart := range uploadedParts {
+		if cPart.PartNumber < 1 || cPart.PartNumber > irodsS3MaxPartID {
+			logger.LogIf(ctx, minio.InvalidPart{PartNumber: cPart.PartNumber})
+			return nil, minio.InvalidPart{PartNumber: cPart.PartNumber}
+		}
+
+		if i > 0 && cPart.PartNumber <= uploadedParts[i-1].PartNumber {
+			logger.LogIf(ctx, minio.InvalidPartOrder{UploadID: uploadID})
+			return nil, minio.InvalidPartOrder{UploadID: uploadID}
+		}
+
+		partObj, pErr := a.getUploadPart(bucket, object, uploadID, cPart.PartNumber)
+		if pErr != nil {
+			logger.LogIf(ctx, pErr)
+			return nil, pErr
+		}
+
+		// Parts uploaded before ETags were stored can't be checked
+		gotETag := strings.Trim(cPart.ETag, "\"")
+		if metas, mErr := partObj.Attribute(irodsETagMetaAttr); mErr == nil && len(metas) > 0 {
+			if expETag := metas[0].Value; expETag != gotETag {
+				logger.LogIf(ctx, minio.InvalidPart{PartNumber: cPart.PartNumber, ExpETag: expETag, GotETag: gotETag})
+				return nil, minio.InvalidPart{
+					PartNumber: cPart.PartNumber,
+					ExpETag:    expETag,
+					GotETag:    gotETag,
+				}
 			}
 		}
-		return nil
-	}); err != nil {
-		return err
-	}
 
-	return rodsObj.Destroy()
+		if i < len(uploadedParts)-1 && partObj.Size() < irodsS3MinPartSize {
+			logger.LogIf(ctx, minio.PartTooSmall{PartNumber: cPart.PartNumber, PartSize: partObj.Size(), PartETag: gotETag})
+			return nil, minio.PartTooSmall{
+				PartNumber: cPart.PartNumber,
+				PartSize:   partObj.Size(),
+				PartETag:   gotETag,
+			}
+		}
+
+		partObjs = append(partObjs, partObj)
+	}
 
+	return partObjs, nil
 }
 
 // CompleteMultipartUpload - Use Irods equivalent PutBlockList.
@@ -1003,12 +2142,11 @@ func (a *irodsObjects) CompleteMultipartUpload(ctx context.Context, bucket, obje
 
 	var metadata irodsMultipartMetadata
 
-	// Get metadata
+	// Get metadata, the upload stays open if completion fails
 	metaObj, mErr := a.getMetaObjectInBucket(bucket, uploadID, object)
 	if mErr != nil {
 		return objInfo, mErr
 	}
-	defer metaObj.Destroy()
 
 	if metaBytes, bErr := metaObj.Read(); bErr == nil {
 		if pErr := json.Unmarshal(metaBytes, &metadata); pErr != nil {
@@ -1016,61 +2154,115 @@ func (a *irodsObjects) CompleteMultipartUpload(ctx context.Context, bucket, obje
 		}
 	}
 
-	mpCol, gErr := a.getMultipartCol(bucket)
-	if gErr != nil {
-		return objInfo, gErr
+	lock, lErr := parseIrodsObjectLock(bucket, object, metadata.Metadata)
+	if lErr != nil {
+		return objInfo, lErr
 	}
 
-	// Create final object
-	finalObj, fErr := a.createRodsObj(bucket, object, true)
+	// The checksum algorithm is chosen when the upload is created
+	flexSum, fErr := getIrodsFlexChecksum(bucket, object, metadata.Metadata)
 	if fErr != nil {
 		return objInfo, fErr
 	}
-	defer finalObj.Close()
 
-	up := minio.CompletedParts(uploadedParts)
+	if err = a.checkObjectLock(ctx, bucket, object); err != nil {
+		return objInfo, err
+	}
+
+	// Validate the part list before writing anything
+	partObjs, vErr := a.getCompleteParts(ctx, bucket, object, uploadID, uploadedParts)
+	if vErr != nil {
+		return objInfo, vErr
+	}
+
+	// Assemble the final object under a hidden name
+	tmpObj, tErr := a.createTmpRodsObj(bucket)
+	if tErr != nil {
+		return objInfo, tErr
+	}
+	defer func() {
+		if err != nil {
+			tmpObj.Destroy()
+		}
+	}()
 
 	// Read parts and write to final object
-	sort.Sort(up)
-	for _, cPart := range up {
-		partObj := mpCol.FindObj(fmt.Sprintf("%s_%i", getMD5Hash(object), cPart.PartNumber))
-		if partObj == nil {
-			return objInfo, fmt.Errorf("Unable to locate multipart object %v %v", object, cPart.PartNumber)
+	for _, partObj := range partObjs {
+		if err = ctx.Err(); err != nil {
+			tmpObj.Close()
+			return objInfo, err
 		}
 
 		if data, dErr := partObj.Read(); dErr == nil {
-			if wErr := finalObj.WriteBytes(data); wErr != nil {
+			if wErr := tmpObj.WriteBytes(data); wErr != nil {
 				return objInfo, wErr
 			}
 		} else {
 			return objInfo, dErr
 		}
-
-		partObj.Destroy()
 	}
+	tmpObj.Close()
 
 	// Add metadata
-	for k, v := range metadata.Metadata {
-		if _, zErr := finalObj.AddMeta(gorods.Meta{
-			"minio_meta_" + k, // Attribute
-			v,                 // Value
-			"",                // Unit
-			nil,
-		}); zErr != nil {
-			return objInfo, zErr
+	if err = applyIrodsObjectMeta(tmpObj, metadata.Metadata); err != nil {
+		return objInfo, err
+	}
+
+	chkSum, kErr := tmpObj.Chksum()
+	if kErr != nil {
+		return objInfo, kErr
+	}
+	sum, sErr := parseIrodsChecksum(chkSum)
+	if sErr != nil {
+		return objInfo, sErr
+	}
+
+	var userDefined map[string]string
+	if flexSum != nil {
+		var composite string
+		if composite, err = getCompositeChecksum(flexSum, uploadedParts, partObjs); err != nil {
+			return objInfo, err
+		}
+		if err = flexSum.Store(tmpObj, composite); err != nil {
+			return objInfo, err
 		}
+		userDefined = map[string]string{irodsFlexChecksumHeader(flexSum.Algorithm): composite}
+	}
+
+	if err = a.applyObjectLock(ctx, tmpObj, lock); err != nil {
+		return objInfo, err
+	}
+
+	if err = applyIrodsObjectTags(tmpObj, metadata.Metadata); err != nil {
+		return objInfo, err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return objInfo, err
+	}
+
+	finalObj, pErr := a.commitRodsObj(ctx, bucket, object, tmpObj)
+	if pErr != nil {
+		return objInfo, pErr
 	}
 
-	chkSum, _ := finalObj.Chksum()
+	// Sealing is best effort, the lock is still enforced by the gateway if
+	// iRODS refuses the change
+	logger.LogIf(ctx, a.sealRodsObj(finalObj, lock))
+
+	// The object is complete, leftovers are reclaimed by the janitor
+	logger.LogIf(ctx, a.removeUploadParts(bucket, uploadID))
+	logger.LogIf(ctx, metaObj.Destroy())
 
 	return minio.ObjectInfo{
 		Bucket:          bucket,
 		Name:            object,
 		ModTime:         finalObj.ModTime(),
 		Size:            finalObj.Size(),
-		ETag:            getMD5Hash(chkSum) + "-1",
+		ETag:            sum.ETag(),
 		ContentType:     getMime(object),
 		ContentEncoding: "",
+		UserDefined:     sum.AddUserDefined(userDefined),
 	}, nil
 }
 